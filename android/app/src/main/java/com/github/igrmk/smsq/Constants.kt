@@ -12,6 +12,7 @@ object Constants {
     const val PREFERENCES = "com.github.igrmk.smsq.preferences"
     const val PREF_DOMAIN_NAME = "domain_name"
     const val PREF_KEY = "key"
+    const val PREF_SECRET = "secret"
     const val PREF_ON = "on"
     const val PREF_CARRIER = "show_carrier"
     const val PREF_FORWARD_CALLS = "forward_calls"
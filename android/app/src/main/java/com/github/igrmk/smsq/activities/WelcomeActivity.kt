@@ -14,9 +14,11 @@ import androidx.core.content.ContextCompat
 import androidx.core.content.PermissionChecker.PERMISSION_GRANTED
 import com.github.igrmk.smsq.Constants
 import com.github.igrmk.smsq.R
+import com.github.igrmk.smsq.entities.DeliveryResult
 import com.github.igrmk.smsq.helpers.*
 import com.github.igrmk.smsq.services.ResenderService
 import android.widget.Toast
+import com.google.crypto.tink.HybridEncrypt
 import kotlinx.android.synthetic.main.activity_welcome.*
 import android.provider.Telephony.Sms.Intents.SMS_RECEIVED_ACTION
 import androidx.localbroadcastmanager.content.LocalBroadcastManager
@@ -218,7 +220,34 @@ class WelcomeActivity : AppCompatActivity() {
     }
 
     fun onConnectClicked(@Suppress("UNUSED_PARAMETER") view: View) {
-        val link = "tg://resolve?domain=${myPreferences.botName}&start=${myPreferences.key}"
+        val key = myPreferences.key ?: return
+        allowRebind(key) { openBot(key) }
+    }
+
+    // allowRebind lets the bot connect a device which has claimed its secret, the request is signed with the secret
+    private fun allowRebind(key: String, then: () -> Unit) {
+        val secret = myPreferences.secret
+        if (secret == null) {
+            then()
+            return
+        }
+        connect.isEnabled = false
+        Thread {
+            val rest = RestTalker(logger(), myPreferences.domainName, Constants.PUBLIC_KEY.getPrimitive(HybridEncrypt::class.java))
+            val (result, _) = rest.allowRebind(key, secret)
+            runOnUiThread {
+                connect.isEnabled = myPreferences.on
+                if (result == DeliveryResult.Delivered) {
+                    then()
+                } else {
+                    Toast.makeText(this, getString(R.string.connection_failed), Toast.LENGTH_SHORT).show()
+                }
+            }
+        }.start()
+    }
+
+    private fun openBot(key: String) {
+        val link = "tg://resolve?domain=${myPreferences.botName}&start=$key"
         try {
             startActivity(Intent(Intent.ACTION_VIEW, Uri.parse(link)))
         } catch (ex: android.content.ActivityNotFoundException) {
@@ -232,9 +261,10 @@ class WelcomeActivity : AppCompatActivity() {
 
     fun onCopyKeyClicked(@Suppress("UNUSED_PARAMETER") view: View) {
         val key = myPreferences.key ?: return
-        val command = "/start $key"
-        copyToClipboard(command)
-        Toast.makeText(this, getString(R.string.key_copied), Toast.LENGTH_SHORT).show()
+        allowRebind(key) {
+            copyToClipboard("/start $key")
+            Toast.makeText(this, getString(R.string.key_copied), Toast.LENGTH_SHORT).show()
+        }
     }
 
     private fun checkShowCarrierSwitch(): Boolean {
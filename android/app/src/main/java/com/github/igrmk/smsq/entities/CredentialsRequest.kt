@@ -0,0 +1,20 @@
+package com.github.igrmk.smsq.entities
+
+import kotlinx.serialization.SerialName
+import kotlinx.serialization.Serializable
+
+@Serializable
+class CredentialsRequest {
+    var key: String = ""
+
+    // one-time AES-256 key the server encrypts the secret with
+    @SerialName("response_key")
+    var responseKey: String? = null
+
+    // a signed rebind lets the bot connect the device to another account instead of claiming the secret
+    var rebind: Boolean = false
+
+    @SerialName("sent_at")
+    var sentAt: Long = 0
+    var nonce: String = ""
+}
@@ -0,0 +1,10 @@
+package com.github.igrmk.smsq.entities
+
+import kotlinx.serialization.*
+
+@Serializable
+class CredentialsResponse : BasicResponse<DeliveryResult> {
+    override var error: String? = null
+    override var result: DeliveryResult? = null
+    var secret: String? = null
+}
@@ -27,7 +27,10 @@ enum class DeliveryResult {
     ApiRetired,
 
     @SerialName("rate_limited")
-    RateLimited
+    RateLimited,
+
+    @SerialName("unauthorized")
+    Unauthorized
 }
 
 val DeliveryResult.serialName: String
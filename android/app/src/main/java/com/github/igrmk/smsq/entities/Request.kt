@@ -6,4 +6,5 @@ import kotlinx.serialization.Serializable
 class Request {
     var payload: String? = null
     var version: Int = 1
+    var mac: String? = null
 }
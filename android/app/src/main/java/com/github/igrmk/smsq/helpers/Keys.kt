@@ -3,6 +3,9 @@ package com.github.igrmk.smsq.helpers
 import android.content.Context
 import com.github.igrmk.smsq.Constants
 import java.security.MessageDigest
+import java.security.SecureRandom
+import javax.crypto.Mac
+import javax.crypto.spec.SecretKeySpec
 
 
 @Suppress("SpellCheckingInspection")
@@ -27,11 +30,26 @@ private fun randomKey(): String {
     }
 }
 
+fun randomBytes(length: Int): ByteArray {
+    val bytes = ByteArray(length)
+    SecureRandom().nextBytes(bytes)
+    return bytes
+}
+
+// payloadMac signs a request payload with the device secret
+fun payloadMac(secret: String, payload: String): ByteArray {
+    val mac = Mac.getInstance("HmacSHA256")
+    mac.init(SecretKeySpec(secret.toByteArray(), "HmacSHA256"))
+    return mac.doFinal(payload.toByteArray())
+}
+
 fun Context.updateKey() {
     myPreferences.key = randomKey()
+    myPreferences.secret = null
 }
 
 fun Context.revokeKey() {
     myPreferences.key = null
+    myPreferences.secret = null
 }
 
@@ -14,6 +14,13 @@ var SharedPreferences.key: String?
         apply()
     }
 
+var SharedPreferences.secret: String?
+    get() = getString(Constants.PREF_SECRET, null)
+    set(value) = with(edit()) {
+        putString(Constants.PREF_SECRET, value)
+        apply()
+    }
+
 var SharedPreferences.domainName: String
     get() = getString(Constants.PREF_DOMAIN_NAME, Constants.DEFAULT_DOMAIN_NAME)!!
     set(value) = with(edit()) {
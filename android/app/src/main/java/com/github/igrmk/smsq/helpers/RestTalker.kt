@@ -6,6 +6,7 @@ import com.github.kittinunf.fuel.Fuel
 import com.github.kittinunf.fuel.core.FuelError
 import com.github.kittinunf.result.Result
 import com.google.crypto.tink.HybridEncrypt
+import com.google.crypto.tink.subtle.AesGcmJce
 import kotlinx.serialization.DeserializationStrategy
 import kotlinx.serialization.SerializationStrategy
 import kotlinx.serialization.json.Json
@@ -19,11 +20,17 @@ class RestTalker(val logger: Logger, private val baseUrl: String, private val hy
     val json = Json(JsonConfiguration.Stable, context = SerializersModule {
         polymorphic(BasicResponse::class) {
             SmsResponse::class with SmsResponse.serializer()
+            CredentialsResponse::class with CredentialsResponse.serializer()
         }
     })
 
     inline fun <U, reified T : BasicResponse<U>> checkErrors(serializer: DeserializationStrategy<T>, requestUrl: URL, result: Result<String, FuelError>): Pair<U?, Boolean> {
-        val obj: BasicResponse<U>?
+        val (obj, gotReply) = checkResponse<U, T>(serializer, requestUrl, result)
+        return Pair(obj?.result, gotReply)
+    }
+
+    inline fun <U, reified T : BasicResponse<U>> checkResponse(serializer: DeserializationStrategy<T>, requestUrl: URL, result: Result<String, FuelError>): Pair<T?, Boolean> {
+        val obj: T?
         val (data, error) = result
         logger.linf(tag, "sent request: '${requestUrl}'")
         if (data == null) {
@@ -46,13 +53,13 @@ class RestTalker(val logger: Logger, private val baseUrl: String, private val hy
             logger.lerr(tag, "REST API error: ${obj.error}")
             return Pair(null, true)
         }
-        return Pair(obj.result, true)
+        return Pair(obj, true)
     }
 
-    fun postSms(data: SmsRequest): Pair<DeliveryResult?, Boolean> {
+    fun postSms(data: SmsRequest, secret: String?): Pair<DeliveryResult?, Boolean> {
         val (req, _, result) = Fuel
                 .post(postSmsUrl(baseUrl))
-                .body(body(SmsRequest.serializer(), data))
+                .body(body(SmsRequest.serializer(), data, secret))
                 .header("Content-Type" to "application/json")
                 .timeout(Constants.SOCKET_TIMEOUT_MS)
                 .timeoutRead(Constants.SOCKET_TIMEOUT_MS)
@@ -60,12 +67,56 @@ class RestTalker(val logger: Logger, private val baseUrl: String, private val hy
         return checkErrors(SmsResponse.serializer(), req.url, result)
     }
 
-    private fun <T> body(serializer: SerializationStrategy<T>, data: T): String {
+    // claimSecret gets the device secret once the bot has connected the device
+    fun claimSecret(key: String): Pair<String?, Boolean> {
+        val responseKey = randomBytes(32)
+        val data = CredentialsRequest().apply {
+            this.key = key
+            this.responseKey = base64(responseKey)
+        }
+        val (response, gotReply) = postCredentials(data, null)
+        val secret = response?.secret
+        if (response?.result != DeliveryResult.Delivered || secret == null) {
+            return Pair(null, gotReply)
+        }
+        val decrypted = AesGcmJce(responseKey).decrypt(android.util.Base64.decode(secret, android.util.Base64.DEFAULT), key.toByteArray())
+        return Pair(String(decrypted), true)
+    }
+
+    // allowRebind lets the bot connect a device which has claimed its secret to another account
+    fun allowRebind(key: String, secret: String): Pair<DeliveryResult?, Boolean> {
+        val data = CredentialsRequest().apply {
+            this.key = key
+            this.rebind = true
+            this.sentAt = System.currentTimeMillis() / 1000
+            this.nonce = randomBytes(16).joinToString("") { "%02x".format(it) }
+        }
+        val (response, gotReply) = postCredentials(data, secret)
+        return Pair(response?.result, gotReply)
+    }
+
+    private fun postCredentials(data: CredentialsRequest, secret: String?): Pair<CredentialsResponse?, Boolean> {
+        val (req, _, result) = Fuel
+                .post(credentialsUrl(baseUrl))
+                .body(body(CredentialsRequest.serializer(), data, secret))
+                .header("Content-Type" to "application/json")
+                .timeout(Constants.SOCKET_TIMEOUT_MS)
+                .timeoutRead(Constants.SOCKET_TIMEOUT_MS)
+                .responseString()
+        return checkResponse<DeliveryResult, CredentialsResponse>(CredentialsResponse.serializer(), req.url, result)
+    }
+
+    private fun <T> body(serializer: SerializationStrategy<T>, data: T, secret: String?): String {
         val payloadJson = json.stringify(serializer, data)
         val request = Request().apply { this.payload = encrypt(payloadJson) }
+        if (secret != null) {
+            request.mac = base64(payloadMac(secret, request.payload!!))
+        }
         return json.stringify(Request.serializer(), request)
     }
 
+    private fun base64(data: ByteArray) = android.util.Base64.encodeToString(data, android.util.Base64.NO_WRAP)
+
     private fun encrypt(str: String): String {
         val encrypted = hybridEncrypt!!.encrypt(str.toByteArray(), null)
         return android.util.Base64.encodeToString(encrypted, android.util.Base64.DEFAULT)
@@ -1,3 +1,5 @@
 package com.github.igrmk.smsq.helpers
 
 fun postSmsUrl(baseUrl: String) = "${baseUrl}v1/sms"
+
+fun credentialsUrl(baseUrl: String) = "${baseUrl}v1/credentials"
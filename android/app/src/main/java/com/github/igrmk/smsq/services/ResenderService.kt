@@ -63,11 +63,24 @@ class ResenderService : Service() {
         resendAttempt++
     }
 
+    // claimSecret gets the secret shortly after the bot has connected the device,
+    // requests are sent unsigned until then
+    private fun claimSecret(key: String): String? {
+        myPreferences.secret?.let { return it }
+        val (secret, _) = rest.claimSecret(key)
+        if (secret != null) {
+            linf(tag, "secret claimed")
+            myPreferences.secret = secret
+        }
+        return secret
+    }
+
     private fun send(): Boolean {
         val key = myPreferences.key ?: return true
+        val secret = claimSecret(key)
         for (i in allSmses()) {
             val req = SmsRequest(i).apply { this.key = key }
-            val (deliveryResult, gotReply) = rest.postSms(req)
+            val (deliveryResult, gotReply) = rest.postSms(req, secret)
             if (!gotReply) {
                 linf(tag, "send failed")
                 return false
@@ -0,0 +1,15 @@
+package com.github.igrmk.smsq
+
+import com.github.igrmk.smsq.helpers.payloadMac
+import org.junit.Test
+import org.junit.Assert.*
+
+class KeysUnitTest {
+    @Test
+    fun macMatchesServer() {
+        // computed by payloadMac of the server
+        val expected = "2e6cfb7a9acf9dbb592f4871bbbcb5346a9114392e3aa50f3a66a49c5f28971f"
+        val mac = payloadMac("c2VjcmV0", "payload").joinToString("") { "%02x".format(it) }
+        assertEquals(expected, mac)
+    }
+}
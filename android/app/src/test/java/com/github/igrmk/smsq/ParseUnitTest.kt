@@ -1,5 +1,6 @@
 package com.github.igrmk.smsq
 
+import com.github.igrmk.smsq.entities.CredentialsResponse
 import com.github.igrmk.smsq.entities.DeliveryResult
 import com.github.igrmk.smsq.entities.SmsResponse
 import com.github.igrmk.smsq.helpers.NopLogger
@@ -45,4 +46,19 @@ class ParseUnitTest {
         assertEquals(null, parsed.first)
         assertEquals(false, parsed.second)
     }
+
+    @Test
+    fun parsingCredentials() {
+        val data = Result.Success<String, FuelError>("""{ "result": "delivered", "secret": "c2VjcmV0" }""")
+        val parsed = rest.checkResponse<DeliveryResult, CredentialsResponse>(CredentialsResponse.serializer(), URL("https://example.com"), data)
+        assertEquals(DeliveryResult.Delivered, parsed.first?.result)
+        assertEquals("c2VjcmV0", parsed.first?.secret)
+    }
+
+    @Test
+    fun parsingUnauthorized() {
+        val data = Result.Success<String, FuelError>("""{ "result": "unauthorized" }""")
+        val parsed = rest.checkErrors(SmsResponse.serializer(), URL("https://example.com"), data)
+        assertEquals(DeliveryResult.Unauthorized, parsed.first)
+    }
 }
@@ -30,13 +30,20 @@ func parseKey(file string) (*keyset.Handle, error) {
 }
 
 func main() {
+	if len(os.Args) < 2 || len(os.Args) > 3 {
+		panic("usage: encryptor <public key> [context info]")
+	}
 	key, err := parseKey(os.Args[1])
 	checkErr(err)
+	var contextInfo []byte
+	if len(os.Args) == 3 {
+		contextInfo = []byte(os.Args[2])
+	}
 	encryptor, err := hybrid.NewHybridEncrypt(key)
 	checkErr(err)
 	bytes, err := ioutil.ReadAll(os.Stdin)
 	checkErr(err)
-	result, err := encryptor.Encrypt(bytes, nil)
+	result, err := encryptor.Encrypt(bytes, contextInfo)
 	checkErr(err)
 	checkErr(binary.Write(os.Stdout, binary.LittleEndian, result))
 }
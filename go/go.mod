@@ -3,11 +3,11 @@ module github.com/igrmk/smsq/go/smsq
 go 1.16
 
 require (
-	github.com/go-telegram-bot-api/telegram-bot-api v1.0.1-0.20200319042609-5e339ed016b0
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/google/tink/go v1.6.1
+	github.com/lib/pq v1.10.9
 	github.com/mattn/go-sqlite3 v1.14.8
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519 // indirect
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
 	google.golang.org/protobuf v1.27.1 // indirect
 )
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/igrmk/smsq/go/smsq/pow"
+)
+
+func main() {
+	difficulty := pow.DefaultDifficulty
+	switch len(os.Args) {
+	case 1:
+	case 2:
+		var err error
+		if difficulty, err = strconv.Atoi(os.Args[1]); err != nil {
+			log.Fatal("usage: key-miner [difficulty]")
+		}
+	default:
+		log.Fatal("usage: key-miner [difficulty]")
+	}
+	key, err := pow.Mine(difficulty)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(key)
+}
@@ -3,15 +3,85 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"log"
+	"os"
 
+	"github.com/google/tink/go/aead"
 	"github.com/google/tink/go/hybrid"
 	"github.com/google/tink/go/insecurecleartextkeyset"
 	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+	"github.com/igrmk/smsq/go/smsq/keys"
 )
 
+// masterKey reads the master key configured in MASTER_KEY, it returns nil if it is not set
+func masterKey() (tink.AEAD, error) {
+	return keys.ReadMasterKey(os.Getenv("MASTER_KEY"))
+}
+
+func readPrivateKey(file string) (*keyset.Handle, error) {
+	mk, err := masterKey()
+	if err != nil {
+		return nil, err
+	}
+	return keys.ReadPrivateKey(file, mk, os.Getenv("MASTER_KEY_PASS"))
+}
+
+// writePrivateKey writes a keyset encrypted with MASTER_KEY or MASTER_KEY_PASS if any of them is set
+func writePrivateKey(kh *keyset.Handle, w io.Writer) error {
+	mk, err := masterKey()
+	if err != nil {
+		return err
+	}
+	data, err := keys.FormatPrivateKey(kh, mk, os.Getenv("MASTER_KEY_PASS"))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// rotate adds a new primary key to an existing keyset keeping old keys for decryption
+func rotate(file string) (*keyset.Handle, error) {
+	kh, err := readPrivateKey(file)
+	if err != nil {
+		return nil, err
+	}
+	manager := keyset.NewManagerFromHandle(kh)
+	if err := manager.Rotate(hybrid.ECIESHKDFAES128CTRHMACSHA256KeyTemplate()); err != nil {
+		return nil, err
+	}
+	return manager.Handle()
+}
+
+func newMasterKey() {
+	kh, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		log.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := insecurecleartextkeyset.Write(kh, keyset.NewJSONWriter(&buf)); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("master key:")
+	fmt.Println(buf.String())
+}
+
 func main() {
-	khPriv, err := keyset.NewHandle(hybrid.ECIESHKDFAES128CTRHMACSHA256KeyTemplate())
+	var khPriv *keyset.Handle
+	var err error
+	switch {
+	case len(os.Args) == 1:
+		khPriv, err = keyset.NewHandle(hybrid.ECIESHKDFAES128CTRHMACSHA256KeyTemplate())
+	case len(os.Args) == 2 && os.Args[1] == "master-key":
+		newMasterKey()
+		return
+	case len(os.Args) == 3 && os.Args[1] == "rotate":
+		khPriv, err = rotate(os.Args[2])
+	default:
+		log.Fatal("usage: keys-generator [master-key | rotate <private key>]")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -33,11 +103,11 @@ func main() {
 
 	buf = bytes.Buffer{}
 
-	exportedPriv := keyset.NewJSONWriter(&buf)
-	if err := insecurecleartextkeyset.Write(khPriv, exportedPriv); err != nil {
+	if err := writePrivateKey(khPriv, &buf); err != nil {
 		log.Fatal(err)
 	}
 
+	fmt.Println("primary key ID:", khPriv.KeysetInfo().PrimaryKeyId)
 	fmt.Println("private key:")
 	fmt.Println(buf.String())
 }
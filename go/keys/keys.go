@@ -0,0 +1,131 @@
+// Package keys reads and writes the private keys of the server.
+//
+// A private key is a Tink keyset stored in cleartext,
+// encrypted with an AEAD master key,
+// or encrypted with a master key derived from a passphrase with Argon2id.
+// The server and the keys generator share this package so that they read each other's keys.
+package keys
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/aead/subtle"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/google/tink/go/tink"
+	"golang.org/x/crypto/argon2"
+)
+
+// SaltLength is the length of salts keys are derived with
+const SaltLength = 16
+
+// Argon2 are the parameters of Argon2id deriving a master key from a passphrase
+type Argon2 struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // in KiB
+	Threads uint8  `json:"threads"`
+}
+
+// DefaultArgon2 is the second recommended option of RFC 9106
+var DefaultArgon2 = Argon2{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+// MasterKey derives an AEAD master key from a passphrase
+func (p Argon2) MasterKey(pass string, salt []byte) (tink.AEAD, error) {
+	return subtle.NewAESGCM(argon2.IDKey([]byte(pass), salt, p.Time, p.Memory, p.Threads, 32))
+}
+
+// NewSalt generates a random salt
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// passKeyset is a keyset encrypted with a master key derived from a passphrase
+type passKeyset struct {
+	Salt   []byte          `json:"salt"`
+	Argon2 Argon2          `json:"argon2"`
+	Keyset json.RawMessage `json:"keyset"`
+}
+
+// ReadMasterKey reads a cleartext AEAD keyset, it returns nil if no file is given
+func ReadMasterKey(file string) (tink.AEAD, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	kh, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(bytes.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	return aead.New(kh)
+}
+
+// ReadPrivateKey reads a keyset encrypted with the master key or the passphrase,
+// it reads a cleartext keyset if neither is given
+func ReadPrivateKey(file string, masterKey tink.AEAD, pass string) (*keyset.Handle, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKey(data, masterKey, pass)
+}
+
+// ParsePrivateKey parses a keyset written by FormatPrivateKey
+func ParsePrivateKey(data []byte, masterKey tink.AEAD, pass string) (*keyset.Handle, error) {
+	if pass != "" {
+		var encrypted passKeyset
+		if err := json.Unmarshal(data, &encrypted); err != nil {
+			return nil, err
+		}
+		if encrypted.Argon2.Time == 0 || encrypted.Argon2.Threads == 0 {
+			return nil, errors.New("no key derivation parameters")
+		}
+		var err error
+		if masterKey, err = encrypted.Argon2.MasterKey(pass, encrypted.Salt); err != nil {
+			return nil, err
+		}
+		data = encrypted.Keyset
+	}
+	if masterKey == nil {
+		return insecurecleartextkeyset.Read(keyset.NewJSONReader(bytes.NewReader(data)))
+	}
+	return keyset.Read(keyset.NewJSONReader(bytes.NewReader(data)), masterKey)
+}
+
+// FormatPrivateKey encrypts a keyset with the passphrase if it is given,
+// with the master key if it is given, and writes it in cleartext otherwise
+func FormatPrivateKey(kh *keyset.Handle, masterKey tink.AEAD, pass string) ([]byte, error) {
+	var buf bytes.Buffer
+	if pass == "" && masterKey == nil {
+		err := insecurecleartextkeyset.Write(kh, keyset.NewJSONWriter(&buf))
+		return buf.Bytes(), err
+	}
+	if pass == "" {
+		err := kh.Write(keyset.NewJSONWriter(&buf), masterKey)
+		return buf.Bytes(), err
+	}
+	salt, err := NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	params := DefaultArgon2
+	if masterKey, err = params.MasterKey(pass, salt); err != nil {
+		return nil, err
+	}
+	if err := kh.Write(keyset.NewJSONWriter(&buf), masterKey); err != nil {
+		return nil, err
+	}
+	return json.Marshal(passKeyset{Salt: salt, Argon2: params, Keyset: buf.Bytes()})
+}
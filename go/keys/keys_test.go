@@ -0,0 +1,104 @@
+package keys
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/tink/go/aead"
+	"github.com/google/tink/go/hybrid"
+	"github.com/google/tink/go/keyset"
+)
+
+func TestPrivateKeyRoundTrip(t *testing.T) {
+	kh, err := keyset.NewHandle(hybrid.ECIESHKDFAES128CTRHMACSHA256KeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterHandle, err := keyset.NewHandle(aead.AES256GCMKeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterKey, err := aead.New(masterHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		masterKey bool
+		pass      string
+	}{
+		{"cleartext", false, ""},
+		{"master key", true, ""},
+		{"passphrase", false, "pass"},
+	}
+	for _, tt := range tests {
+		mk := masterKey
+		if !tt.masterKey {
+			mk = nil
+		}
+		data, err := FormatPrivateKey(kh, mk, tt.pass)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		read, err := ParsePrivateKey(data, mk, tt.pass)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if read.KeysetInfo().PrimaryKeyId != kh.KeysetInfo().PrimaryKeyId {
+			t.Errorf("%s: primary key ID = %d, want %d", tt.name, read.KeysetInfo().PrimaryKeyId, kh.KeysetInfo().PrimaryKeyId)
+		}
+		if tt.pass != "" {
+			if _, err := ParsePrivateKey(data, mk, "wrong"); err == nil {
+				t.Errorf("%s: a wrong passphrase is accepted", tt.name)
+			}
+		}
+	}
+}
+
+func TestArgon2Stored(t *testing.T) {
+	kh, err := keyset.NewHandle(hybrid.ECIESHKDFAES128CTRHMACSHA256KeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := FormatPrivateKey(kh, nil, "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored passKeyset
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Argon2 != DefaultArgon2 {
+		t.Errorf("argon2 = %v, want %v", stored.Argon2, DefaultArgon2)
+	}
+	if DefaultArgon2.Time < 3 || DefaultArgon2.Memory < 64*1024 {
+		t.Errorf("argon2 parameters %v are below RFC 9106", DefaultArgon2)
+	}
+}
+
+func TestPassKeysetWithoutArgon2(t *testing.T) {
+	kh, err := keyset.NewHandle(hybrid.ECIESHKDFAES128CTRHMACSHA256KeyTemplate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk, err := DefaultArgon2.MasterKey("pass", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := kh.Write(keyset.NewJSONWriter(&buf), mk); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]interface{}{"salt": salt, "keyset": json.RawMessage(buf.Bytes())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePrivateKey(data, nil, "pass"); err == nil {
+		t.Error("a key without parameters is read")
+	}
+}
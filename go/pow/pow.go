@@ -0,0 +1,130 @@
+// Package pow implements the proof of work device keys are required to carry.
+//
+// A key is valid if the double SHA-256 of it starts with enough zero bits.
+// Version 1 keys are 64 lowercase letters with a fixed difficulty of 12 bits.
+// Version 2 keys start with the digit 2 followed by 63 lowercase letters,
+// their difficulty is configured on the server.
+package pow
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+)
+
+// KeyLength is the length of a device key
+const KeyLength = 64
+
+// V1Difficulty is the fixed difficulty of version 1 keys
+const V1Difficulty = 12
+
+// DefaultDifficulty is the difficulty of newly generated keys unless configured otherwise
+const DefaultDifficulty = 16
+
+const letters = "abcdefghijklmnopqrstuvwxyz"
+
+// ZeroBits returns the number of leading zero bits of the double SHA-256 of a key
+func ZeroBits(key string) int {
+	hash := sha256.Sum256([]byte(key))
+	hash = sha256.Sum256(hash[:])
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+func isLetters(s string) bool {
+	for _, c := range []byte(s) {
+		if c < 'a' || c > 'z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Version returns the format version of a key, it returns 0 for malformed keys
+func Version(key string) int {
+	if len(key) != KeyLength {
+		return 0
+	}
+	if isLetters(key) {
+		return 1
+	}
+	if version, err := strconv.Atoi(key[:1]); err == nil && version == 2 && isLetters(key[1:]) {
+		return version
+	}
+	return 0
+}
+
+// Check checks a key against its version,
+// version 1 keys are checked against V1Difficulty, version 2 keys against difficulty
+func Check(key string, difficulty int) bool {
+	switch Version(key) {
+	case 1:
+		return ZeroBits(key) >= V1Difficulty
+	case 2:
+		return ZeroBits(key) >= difficulty
+	}
+	return false
+}
+
+// randomLetters fills a buffer with uniformly distributed random letters
+func randomLetters(buf []byte) error {
+	random := make([]byte, 1)
+	for i := 0; i < len(buf); {
+		if _, err := rand.Read(random); err != nil {
+			return err
+		}
+		// rejecting values above the largest multiple of len(letters) keeps the distribution uniform
+		if int(random[0]) >= 256-256%len(letters) {
+			continue
+		}
+		buf[i] = letters[int(random[0])%len(letters)]
+		i++
+	}
+	return nil
+}
+
+// next advances the letters of a key as an odometer
+func next(key []byte) {
+	for i := len(key) - 1; i > 0; i-- {
+		if key[i] != 'z' {
+			key[i]++
+			return
+		}
+		key[i] = 'a'
+	}
+}
+
+// mine advances a key until it meets the difficulty
+func mine(key []byte, difficulty int) string {
+	for ZeroBits(string(key)) < difficulty {
+		next(key)
+	}
+	return string(key)
+}
+
+// Mine generates a version 2 key of a given difficulty
+func Mine(difficulty int) (string, error) {
+	key := make([]byte, KeyLength)
+	key[0] = '2'
+	if err := randomLetters(key[1:]); err != nil {
+		return "", err
+	}
+	return mine(key, difficulty), nil
+}
+
+// MineV1 generates a version 1 key the way old apps do,
+// it is meant for testing the servers still accepting them
+func MineV1() (string, error) {
+	key := make([]byte, KeyLength)
+	if err := randomLetters(key); err != nil {
+		return "", err
+	}
+	return mine(key, V1Difficulty), nil
+}
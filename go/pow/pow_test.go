@@ -0,0 +1,99 @@
+package pow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{strings.Repeat("a", KeyLength), 1},
+		{"2" + strings.Repeat("a", KeyLength-1), 2},
+		{"3" + strings.Repeat("a", KeyLength-1), 0},
+		{strings.Repeat("a", KeyLength-1), 0},
+		{strings.Repeat("a", KeyLength+1), 0},
+		{"2" + strings.Repeat("A", KeyLength-1), 0},
+		{"", 0},
+	}
+	for _, tt := range tests {
+		if got := Version(tt.key); got != tt.want {
+			t.Errorf("Version(%q) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestZeroBits(t *testing.T) {
+	key, err := MineV1()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := ZeroBits(key); n < V1Difficulty || Version(key) != 1 {
+		t.Errorf("MineV1() = %q of %d bits, want a version 1 key of at least %d", key, n, V1Difficulty)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	v1, err := MineV1()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := Mine(V1Difficulty + 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		key        string
+		difficulty int
+		want       bool
+	}{
+		{"v1 ignores the difficulty", v1, 20, true},
+		{"v2 meets the difficulty", v2, V1Difficulty + 2, true},
+		{"v2 below the difficulty", v2, ZeroBits(v2) + 1, false},
+		{"v1 without the work", strings.Repeat("a", KeyLength), V1Difficulty, false},
+		{"malformed", strings.ToUpper(v1), V1Difficulty, false},
+	}
+	for _, tt := range tests {
+		if got := Check(tt.key, tt.difficulty); got != tt.want {
+			t.Errorf("%s: Check = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMine(t *testing.T) {
+	for difficulty := 0; difficulty <= V1Difficulty; difficulty += 4 {
+		key, err := Mine(difficulty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Version(key) != 2 || ZeroBits(key) < difficulty {
+			t.Errorf("Mine(%d) = %q", difficulty, key)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	key := []byte("2azz")
+	next(key)
+	if string(key) != "2baa" {
+		t.Errorf("next = %q, want 2baa", key)
+	}
+}
+
+func BenchmarkZeroBits(b *testing.B) {
+	key := strings.Repeat("a", KeyLength)
+	for i := 0; i < b.N; i++ {
+		ZeroBits(key)
+	}
+}
+
+func BenchmarkMine(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := Mine(V1Difficulty); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultFeedbacks = 10
+
+func formatTime(unix int64) string {
+	if unix == 0 {
+		return "never"
+	}
+	return time.Unix(unix, 0).UTC().Format("2006-01-02 15:04:05")
+}
+
+func (w *worker) chatBanned(chatID int64) bool {
+	return singleInt(w.db.QueryRow("select count(*) from banned_chats where chat_id=?", chatID)) != 0
+}
+
+func (w *worker) keyBanned(key string) bool {
+	return singleInt(w.db.QueryRow("select count(*) from banned_keys where key=?", key)) != 0
+}
+
+// user shows devices, counters, limits and last activity of a chat
+func (w *worker) user(adminID int64, arguments string) {
+	chatID, err := strconv.ParseInt(strings.TrimSpace(arguments), 10, 64)
+	if err != nil {
+		_ = w.sendText(adminID, false, parseRaw, "Usage: /user chatID")
+		return
+	}
+	query, err := w.db.Query(`
+		select key, name, delivered, daily_limit, deleted, last_seen
+		from devices where chat_id=? order by deleted, last_seen desc`,
+		chatID)
+	checkErr(err)
+	type userDevice struct {
+		device
+		deleted  bool
+		lastSeen int64
+	}
+	var devices []userDevice
+	for query.Next() {
+		var d userDevice
+		checkErr(query.Scan(&d.key, &d.name, &d.delivered, &d.dailyLimit, &d.deleted, &d.lastSeen))
+		devices = append(devices, d)
+	}
+	checkErr(query.Close())
+
+	if len(devices) == 0 && !w.chatBanned(chatID) {
+		_ = w.sendText(adminID, false, parseRaw, "User not found")
+		return
+	}
+
+	now := time.Now()
+	lines := []string{fmt.Sprintf("user %d", chatID)}
+	if w.chatBanned(chatID) {
+		lines = append(lines, "banned")
+	}
+	if w.chatBlocked(chatID) {
+		lines = append(lines, "blocked the bot")
+	}
+	lastSeen := int64(0)
+	for _, d := range devices {
+		status := "active"
+		if d.deleted {
+			status = "deleted"
+		}
+		if w.keyBanned(d.key) {
+			status += ", banned"
+		}
+		if d.lastSeen > lastSeen {
+			lastSeen = d.lastSeen
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s) %s: %d msgs, %v, last seen %s",
+			d.key, d.name, status, d.delivered, w.quota(w.db, d.key, d.dailyLimit, now), formatTime(d.lastSeen)))
+	}
+	lines = append(lines, fmt.Sprintf("last activity: %s", formatTime(lastSeen)))
+	lines = append(lines, fmt.Sprintf("feedbacks: %d", singleInt(w.db.QueryRow("select count(*) from feedback where chat_id=?", chatID))))
+	_ = w.sendText(adminID, false, parseRaw, strings.Join(lines, "\n"))
+}
+
+// ban blocks a chat or a device key from both the bot and the API
+func (w *worker) ban(adminID int64, arguments string, banned bool) {
+	command := "/unban"
+	if banned {
+		command = "/ban"
+	}
+	target := strings.TrimSpace(arguments)
+	if target == "" {
+		_ = w.sendText(adminID, false, parseRaw, fmt.Sprintf("Usage: %s chatID|key", command))
+		return
+	}
+	w.setBanned(target, banned)
+	_ = w.sendText(adminID, false, parseRaw, "OK")
+}
+
+// setBanned bans or unbans a chat ID or a device key
+func (w *worker) setBanned(target string, banned bool) {
+	now := time.Now().Unix()
+	if chatID, err := strconv.ParseInt(target, 10, 64); err == nil {
+		if banned {
+			w.mustExec("insert into banned_chats (chat_id, banned_at) values (?, ?) on conflict(chat_id) do nothing", chatID, now)
+		} else {
+			w.mustExec("delete from banned_chats where chat_id=?", chatID)
+		}
+		return
+	}
+	if banned {
+		w.mustExec("insert into banned_keys (key, banned_at) values (?, ?) on conflict(key) do nothing", target, now)
+	} else {
+		w.mustExec("delete from banned_keys where key=?", target)
+	}
+}
+
+func validKeyPrefix(prefix string) bool {
+	for _, c := range []byte(prefix) {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return prefix != ""
+}
+
+// deviceKey looks devices up by a key prefix
+func (w *worker) deviceKey(adminID int64, arguments string) {
+	prefix := strings.TrimSpace(arguments)
+	if !validKeyPrefix(prefix) {
+		_ = w.sendText(adminID, false, parseRaw, "Usage: /devicekey prefix")
+		return
+	}
+	query, err := w.db.Query("select key, chat_id, deleted from devices where key like ? order by key limit 10", prefix+"%")
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	var lines []string
+	for query.Next() {
+		var key string
+		var chatID int64
+		var deleted bool
+		checkErr(query.Scan(&key, &chatID, &deleted))
+		line := fmt.Sprintf("%s: chat %d", key, chatID)
+		if deleted {
+			line += ", deleted"
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		_ = w.sendText(adminID, false, parseRaw, "Device not found")
+		return
+	}
+	_ = w.sendText(adminID, false, parseRaw, strings.Join(lines, "\n"))
+}
+
+// feedbacks shows the latest feedbacks
+func (w *worker) feedbacks(adminID int64, arguments string) {
+	n := defaultFeedbacks
+	if arguments = strings.TrimSpace(arguments); arguments != "" {
+		var err error
+		if n, err = strconv.Atoi(arguments); err != nil || n <= 0 {
+			_ = w.sendText(adminID, false, parseRaw, "Usage: /feedbacks [n]")
+			return
+		}
+	}
+	query, err := w.db.Query("select chat_id, text, created from feedback order by created desc limit ?", n)
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	var lines []string
+	for query.Next() {
+		var chatID, created int64
+		var text string
+		checkErr(query.Scan(&chatID, &text, &created))
+		lines = append(lines, fmt.Sprintf("%s %d: %s", formatTime(created), chatID, text))
+	}
+	if len(lines) == 0 {
+		_ = w.sendText(adminID, false, parseRaw, "No feedbacks")
+		return
+	}
+	_ = w.sendText(adminID, false, parseRaw, strings.Join(lines, "\n"))
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/igrmk/smsq/go/smsq/keys"
+)
+
+// backupMagic starts backups encrypted with backup_password
+const backupMagic = "smsq-backup-1\n"
+
+// encryptBackup encrypts a backup with a key derived from the passphrase
+func encryptBackup(data []byte, pass string) ([]byte, error) {
+	salt, err := keys.NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	key, err := keys.DefaultArgon2.MasterKey(pass, salt)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := key.Encrypt(data, []byte(backupMagic))
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(backupMagic), salt...), ciphertext...), nil
+}
+
+// decryptBackup decrypts an encrypted backup, other backups are returned as is
+func decryptBackup(data []byte, pass string) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(backupMagic)) {
+		return data, nil
+	}
+	if pass == "" {
+		return nil, errors.New("the backup is encrypted, configure backup_password")
+	}
+	data = data[len(backupMagic):]
+	if len(data) < keys.SaltLength {
+		return nil, errors.New("the backup is truncated")
+	}
+	key, err := keys.DefaultArgon2.MasterKey(pass, data[:keys.SaltLength])
+	if err != nil {
+		return nil, err
+	}
+	return key.Decrypt(data[keys.SaltLength:], []byte(backupMagic))
+}
+
+// backup writes an online copy of the database to a new file,
+// it is encrypted if backup_password is configured
+func (w *worker) backup(file string) error {
+	if w.db.dialect != sqlite {
+		return errors.New("only SQLite databases can be backed up, use pg_dump for PostgreSQL")
+	}
+	// the copy is made in a private directory so that no plaintext reaches the destination
+	dir, err := ioutil.TempDir("", "smsq-vacuum")
+	if err != nil {
+		return err
+	}
+	defer func() { checkErr(os.RemoveAll(dir)) }()
+	copied := filepath.Join(dir, "smsq.db")
+	if _, err := w.db.Exec("vacuum into ?", copied); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(copied)
+	if err != nil {
+		return err
+	}
+	if pass := w.cfg().BackupPassword; pass != "" {
+		if data, err = encryptBackup(data, pass); err != nil {
+			return err
+		}
+	}
+	out, err := os.OpenFile(filepath.Clean(file), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func backupName(now time.Time, encrypted bool) string {
+	name := "smsq-" + now.UTC().Format("20060102-150405") + ".db"
+	if encrypted {
+		name += ".enc"
+	}
+	return name
+}
+
+// sendBackup sends a backup to the admin as a document
+func (w *worker) sendBackup(adminID int64) {
+	dir, err := ioutil.TempDir("", "smsq-backup")
+	checkErr(err)
+	defer func() { checkErr(os.RemoveAll(dir)) }()
+	file := filepath.Join(dir, backupName(time.Now(), w.cfg().BackupPassword != ""))
+	if err := w.backup(file); err != nil {
+		lerr("cannot back up the database, %v", err)
+		_ = w.sendText(adminID, false, parseRaw, fmt.Sprintf("Cannot back up the database: %v", err))
+		return
+	}
+	caption := fmt.Sprintf("Schema version %d", schemaVersion(w.db))
+	if w.cfg().BackupPassword != "" {
+		caption += ", encrypted"
+	}
+	if _, err := w.bot.SendDocument(adminID, file, caption); err != nil {
+		lerr("cannot send the backup, %v", err)
+		_ = w.sendText(adminID, false, parseRaw, "Cannot send the backup")
+	}
+}
+
+// backupCommand backs up the database to a file
+func backupCommand(args []string) {
+	if len(args) < 1 {
+		panic("usage: smsq backup <file> [flags] [config]")
+	}
+	w := newWorker(args[1:])
+	checkErr(w.backup(args[0]))
+	linf("backed up to %s", args[0])
+}
+
+// restoreCommand replaces the database with a backup after checking its schema version,
+// the replaced database is kept next to it
+func restoreCommand(args []string) {
+	if len(args) < 1 {
+		panic("usage: smsq restore <file> [flags] [config]")
+	}
+	w := newWorker(args[1:])
+	if w.db.dialect != sqlite {
+		panic("only SQLite databases can be restored, use pg_restore for PostgreSQL")
+	}
+	dbPath := w.cfg().DBPath
+	if running := runningInstances(w.db, time.Now()); running != 0 {
+		panic(fmt.Sprintf("%d instance(s) are running, stop them first", running))
+	}
+	checkErr(w.db.Close())
+
+	data, err := ioutil.ReadFile(filepath.Clean(args[0]))
+	checkErr(err)
+	data, err = decryptBackup(data, w.cfg().BackupPassword)
+	checkErr(err)
+	restored := dbPath + ".restore"
+	checkErr(ioutil.WriteFile(restored, data, 0600))
+	db, err := sql.Open("sqlite3", restored)
+	checkErr(err)
+	version := schemaVersion(&database{DB: db, dialect: sqlite})
+	checkErr(db.Close())
+	if latest := latestVersion(); version > latest {
+		checkErr(os.Remove(restored))
+		panic(fmt.Sprintf("the backup schema version %d is newer than %d supported by this build", version, latest))
+	}
+
+	if _, err := os.Stat(dbPath); err == nil {
+		checkErr(os.Rename(dbPath, dbPath+".before-restore"))
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			checkErr(err)
+		}
+	}
+	checkErr(os.Rename(restored, dbPath))
+	linf("restored schema version %d, %d migration(s) will be applied on start", version, latestVersion()-version)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/igrmk/smsq/go/smsq/telegram"
+)
+
+const (
+	broadcastPreview   = "preview"
+	broadcastRunning   = "running"
+	broadcastDone      = "done"
+	broadcastCancelled = "cancelled"
+)
+
+type broadcastJob struct {
+	id      int64
+	adminID int64
+	text    string
+	status  string
+	total   int
+	sent    int
+	failed  int
+	blocked int
+}
+
+func (j broadcastJob) String() string {
+	return fmt.Sprintf("broadcast #%d %s: %d of %d sent, %d failed, %d blocked",
+		j.id, j.status, j.sent, j.total, j.failed, j.blocked)
+}
+
+// broadcastJobs returns broadcasts with given statuses, the latest first
+func (w *worker) broadcastJobs(statuses ...string) (jobs []broadcastJob) {
+	args := make([]interface{}, len(statuses))
+	for i, s := range statuses {
+		args[i] = s
+	}
+	query, err := w.db.Query(`
+		select id, admin_id, text, status, total, sent, failed, blocked
+		from broadcasts where status in (?`+strings.Repeat(", ?", len(statuses)-1)+`) order by id desc`,
+		args...)
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	for query.Next() {
+		var j broadcastJob
+		checkErr(query.Scan(&j.id, &j.adminID, &j.text, &j.status, &j.total, &j.sent, &j.failed, &j.blocked))
+		jobs = append(jobs, j)
+	}
+	return
+}
+
+func (w *worker) broadcastJob(id int64) broadcastJob {
+	j := broadcastJob{id: id}
+	row := w.db.QueryRow("select admin_id, text, status, total, sent, failed, blocked from broadcasts where id=?", id)
+	checkErr(row.Scan(&j.adminID, &j.text, &j.status, &j.total, &j.sent, &j.failed, &j.blocked))
+	return j
+}
+
+// broadcast prepares a broadcast and sends its preview to the admin
+func (w *worker) broadcast(adminID int64, text string) {
+	if text == "" {
+		_ = w.sendText(adminID, false, parseRaw, "Usage: /broadcast text")
+		return
+	}
+	if running := w.broadcastJobs(broadcastRunning); len(running) != 0 {
+		_ = w.sendText(adminID, false, parseRaw, "Another broadcast is running, see /broadcast_status")
+		return
+	}
+	w.mustExec("update broadcasts set status=? where status=?", broadcastCancelled, broadcastPreview)
+	var id int64
+	checkErr(w.db.QueryRow(
+		"insert into broadcasts (admin_id, text, status, created) values (?, ?, ?, ?) returning id",
+		adminID,
+		text,
+		broadcastPreview,
+		time.Now().Unix()).Scan(&id))
+	chats := w.broadcastChats()
+	tx, err := w.db.Begin()
+	checkErr(err)
+	// a failed insert does not keep the write lock, rolling back after the commit does nothing
+	defer func() { _ = tx.Rollback() }()
+	for _, chatID := range chats {
+		_, err = tx.Exec("insert into broadcast_queue (broadcast_id, chat_id) values (?, ?)", id, chatID)
+		checkErr(err)
+	}
+	checkErr(tx.Commit())
+	w.mustExec("update broadcasts set total=(select count(*) from broadcast_queue where broadcast_id=?) where id=?", id, id)
+	_ = w.sendText(adminID, false, parseRaw, text)
+	_ = w.sendText(adminID, false, parseRaw, fmt.Sprintf(
+		"This is a preview of broadcast #%d to %d chats. Use /broadcast_confirm to send it or /broadcast_cancel to discard it",
+		id,
+		w.broadcastJob(id).total))
+}
+
+func (w *worker) broadcastConfirm(adminID int64) {
+	previews := w.broadcastJobs(broadcastPreview)
+	if len(previews) == 0 {
+		_ = w.sendText(adminID, false, parseRaw, "Nothing to confirm, use /broadcast text")
+		return
+	}
+	id := previews[0].id
+	w.mustExec("update broadcasts set status=? where id=?", broadcastRunning, id)
+	_ = w.sendText(adminID, false, parseRaw, fmt.Sprintf("Broadcast #%d started", id))
+	go w.runBroadcast(id)
+}
+
+func (w *worker) broadcastStatus(adminID int64) {
+	jobs := w.broadcastJobs(broadcastPreview, broadcastRunning, broadcastDone, broadcastCancelled)
+	if len(jobs) == 0 {
+		_ = w.sendText(adminID, false, parseRaw, "No broadcasts")
+		return
+	}
+	var lines []string
+	for i, j := range jobs {
+		if i == 5 {
+			break
+		}
+		lines = append(lines, j.String())
+	}
+	_ = w.sendText(adminID, false, parseRaw, strings.Join(lines, "\n"))
+}
+
+func (w *worker) broadcastCancel(adminID int64) {
+	result := w.mustExec("update broadcasts set status=? where status in (?, ?)", broadcastCancelled, broadcastPreview, broadcastRunning)
+	rows, err := result.RowsAffected()
+	checkErr(err)
+	if rows == 0 {
+		_ = w.sendText(adminID, false, parseRaw, "Nothing to cancel")
+		return
+	}
+	_ = w.sendText(adminID, false, parseRaw, "OK")
+}
+
+// resumeBroadcasts continues broadcasts interrupted by a restart or started by a previous leader
+func (w *worker) resumeBroadcasts() {
+	for _, j := range w.broadcastJobs(broadcastRunning) {
+		linf("resuming broadcast #%d", j.id)
+		go w.runBroadcast(j.id)
+	}
+}
+
+func (w *worker) nextRecipient(id int64) (int64, bool) {
+	query, err := w.db.Query("select chat_id from broadcast_queue where broadcast_id=? limit 1", id)
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	if !query.Next() {
+		return 0, false
+	}
+	var chatID int64
+	checkErr(query.Scan(&chatID))
+	return chatID, true
+}
+
+// claimRecipient removes a recipient from the queue,
+// it fails if another instance has already claimed the recipient
+func (w *worker) claimRecipient(id int64, chatID int64) bool {
+	result := w.mustExec("delete from broadcast_queue where broadcast_id=? and chat_id=?", id, chatID)
+	rows, err := result.RowsAffected()
+	checkErr(err)
+	return rows == 1
+}
+
+// runBroadcast sends a broadcast in the background
+// respecting the configured rate and the delays Telegram asks for
+func (w *worker) runBroadcast(id int64) {
+	if _, running := w.broadcasts.LoadOrStore(id, true); running {
+		return
+	}
+	defer w.broadcasts.Delete(id)
+	limiter := time.NewTicker(time.Second / time.Duration(w.cfg().broadcastRate()))
+	defer limiter.Stop()
+	for {
+		j := w.broadcastJob(id)
+		if j.status != broadcastRunning {
+			linf("broadcast #%d stopped: %s", id, j.status)
+			return
+		}
+		chatID, ok := w.nextRecipient(id)
+		if !ok {
+			result := w.mustExec("update broadcasts set status=? where id=? and status=?", broadcastDone, id, broadcastRunning)
+			rows, err := result.RowsAffected()
+			checkErr(err)
+			if rows == 1 {
+				_ = w.sendText(j.adminID, false, parseRaw, w.broadcastJob(id).String())
+			}
+			return
+		}
+		if !w.claimRecipient(id, chatID) {
+			continue
+		}
+		<-limiter.C
+		err := w.sendText(chatID, true, parseRaw, j.text)
+		if tgErr, ok := err.(telegram.Error); ok && tgErr.RetryAfter > 0 {
+			w.mustExec("insert into broadcast_queue (broadcast_id, chat_id) values (?, ?) on conflict do nothing", id, chatID)
+			time.Sleep(time.Duration(tgErr.RetryAfter) * time.Second)
+			continue
+		}
+		switch err {
+		case nil:
+			w.mustExec("update broadcasts set sent=sent+1 where id=?", id)
+		case errBlockedByUser:
+			w.mustExec("update broadcasts set blocked=blocked+1 where id=?", id)
+		default:
+			w.mustExec("update broadcasts set failed=failed+1 where id=?", id)
+		}
+	}
+}
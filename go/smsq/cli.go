@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/tink/go/hybrid"
+	"github.com/google/tink/go/insecurecleartextkeyset"
+	"github.com/google/tink/go/keyset"
+	"github.com/igrmk/smsq/go/smsq/keys"
+)
+
+// cliCommand is a subcommand of the binary,
+// its arguments are followed by config flags and the config file shared by all commands
+type cliCommand struct {
+	name  string
+	usage string
+	help  string
+	run   func(args []string)
+}
+
+func cliCommands() []cliCommand {
+	return []cliCommand{
+		{"serve", "", "run the bot and the API, the default command", serveCommand},
+		{"migrate", "status|up|down", "show, apply or revert migrations", migrateCommand},
+		{"check-config", "", "validate the config and print it with secrets masked", checkConfigCommand},
+		{"webhook", "set|info|remove", "manage the Telegram webhook", webhookCommand},
+		{"user", "list|limit <chatID> <limit>", "list users or set the daily limit of a user", userCommand},
+		{"send-test", "<chatID>", "send a test message to a chat", sendTestCommand},
+		{"keygen", "", "generate the private key configured in private_key", keygenCommand},
+		{"backup", "<file>", "write a copy of the database", backupCommand},
+		{"restore", "<file>", "replace the database with a backup", restoreCommand},
+	}
+}
+
+func usage() {
+	fmt.Println("usage: smsq [command] [arguments] [flags] [config]")
+	fmt.Println("commands:")
+	for _, c := range cliCommands() {
+		fmt.Printf("  %-14s %-30s %s\n", c.name, c.usage, c.help)
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if os.Args[1] == "help" {
+			usage()
+			return
+		}
+		for _, c := range cliCommands() {
+			if c.name == os.Args[1] {
+				c.run(os.Args[2:])
+				return
+			}
+		}
+	}
+	// existing deployments pass the config without a command
+	serveCommand(os.Args[1:])
+}
+
+// commandArgs splits the command arguments from the config arguments following them
+func commandArgs(args []string, n int, command string) ([]string, []string) {
+	if len(args) < n {
+		for _, c := range cliCommands() {
+			if c.name == command {
+				panic(fmt.Sprintf("usage: smsq %s %s [flags] [config]", c.name, c.usage))
+			}
+		}
+	}
+	return args[:n], args[n:]
+}
+
+// checkConfigCommand exits with an error if the config is invalid
+func checkConfigCommand(args []string) {
+	cfg, err := loadConfig(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "config is invalid, %v\n", err)
+		os.Exit(1)
+	}
+	cfgString, err := json.MarshalIndent(cfg.redacted(), "", "    ")
+	checkErr(err)
+	fmt.Println(string(cfgString))
+	fmt.Println("config is valid")
+}
+
+func webhookCommand(args []string) {
+	command, args := commandArgs(args, 1, "webhook")
+	w := newWorker(args)
+	switch command[0] {
+	case "set":
+		w.createDatabase()
+		checkErr(w.setWebhook())
+	case "info":
+		info, err := w.bot.GetWebhookInfo()
+		checkErr(err)
+		fmt.Printf("url: %s\n", info.URL)
+		fmt.Printf("custom certificate: %v\n", info.HasCustomCertificate)
+		fmt.Printf("pending updates: %d\n", info.PendingUpdateCount)
+		if info.LastErrorDate != 0 {
+			fmt.Printf("last error: %s, %s\n", formatTime(info.LastErrorDate), info.LastErrorMessage)
+		}
+	case "remove":
+		if running := runningInstances(w.db, time.Now()); running != 0 {
+			linf("%d instance(s) are running, they receive no updates until the webhook is set", running)
+		}
+		w.removeWebhook()
+	default:
+		panic("unknown webhook command " + command[0])
+	}
+}
+
+func userCommand(args []string) {
+	command, args := commandArgs(args, 1, "user")
+	switch command[0] {
+	case "list":
+		newWorker(args).listUsers()
+	case "limit":
+		limitArgs, args := commandArgs(args, 2, "user")
+		chatID, err := strconv.ParseInt(limitArgs[0], 10, 64)
+		checkErr(err)
+		limit, err := strconv.ParseInt(limitArgs[1], 10, 64)
+		checkErr(err)
+		if !newWorker(args).setLimit(chatID, limit) {
+			panic("user not found")
+		}
+		linf("daily limit of %d is set to %d", chatID, limit)
+	default:
+		panic("unknown user command " + command[0])
+	}
+}
+
+// listUsers prints chats having active devices
+func (w *worker) listUsers() {
+	query, err := w.db.Query(`
+		select chat_id, count(*), sum(delivered), max(daily_limit), max(last_seen)
+		from devices where deleted=0 group by chat_id order by chat_id`)
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	fmt.Printf("%-16s %7s %9s %11s %s\n", "chat", "devices", "delivered", "daily limit", "last seen")
+	for query.Next() {
+		var chatID, lastSeen int64
+		var devices, delivered, dailyLimit int
+		checkErr(query.Scan(&chatID, &devices, &delivered, &dailyLimit, &lastSeen))
+		fmt.Printf("%-16d %7d %9d %11d %s\n", chatID, devices, delivered, dailyLimit, formatTime(lastSeen))
+	}
+	checkErr(query.Err())
+}
+
+func sendTestCommand(args []string) {
+	chat, args := commandArgs(args, 1, "send-test")
+	chatID, err := strconv.ParseInt(chat[0], 10, 64)
+	checkErr(err)
+	w := newWorker(args)
+	checkErr(w.sendText(chatID, true, parseRaw, "Test message from smsq"))
+	linf("sent a test message to %d", chatID)
+}
+
+// keygenCommand writes a new private key to private_key encrypted with the configured master key
+// and prints the public key for the app
+func keygenCommand(args []string) {
+	cfg, err := parseConfig(args)
+	checkErr(err)
+	if cfg.PrivateKey == "" {
+		panic("configure private_key")
+	}
+	if _, err := os.Stat(cfg.PrivateKey); err == nil {
+		panic(cfg.PrivateKey + " exists, use keys-generator to rotate it")
+	}
+	masterKey, err := keys.ReadMasterKey(cfg.MasterKey)
+	checkErr(err)
+	kh, err := keyset.NewHandle(hybrid.ECIESHKDFAES128CTRHMACSHA256KeyTemplate())
+	checkErr(err)
+	data, err := keys.FormatPrivateKey(kh, masterKey, cfg.MasterKeyPass)
+	checkErr(err)
+	checkErr(ioutil.WriteFile(filepath.Clean(cfg.PrivateKey), data, 0600))
+	public, err := kh.Public()
+	checkErr(err)
+	var buf bytes.Buffer
+	checkErr(insecurecleartextkeyset.Write(public, keyset.NewJSONWriter(&buf)))
+	linf("private key is written to %s, primary key ID %d", cfg.PrivateKey, kh.KeysetInfo().PrimaryKeyId)
+	fmt.Println(buf.String())
+}
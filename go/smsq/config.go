@@ -1,74 +1,346 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
-	"io"
-	"io/ioutil"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
-	"github.com/google/tink/go/insecurecleartextkeyset"
 	"github.com/google/tink/go/keyset"
+	"github.com/igrmk/smsq/go/smsq/keys"
+	"github.com/igrmk/smsq/go/smsq/pow"
 )
 
+type adminConfig struct {
+	ID   int64 `json:"id"`   // admin Telegram ID
+	Role role  `json:"role"` // viewer, operator or owner
+}
+
 type config struct {
-	ListenAddress  string            `json:"listen_address"`  // the address to listen to incoming Telegram messages
-	APIDomain      string            `json:"api_domain"`      // the domain name for API
-	WebhookDomain  string            `json:"webhook_domain"`  // the domain name for the webhook
-	BotToken       string            `json:"bot_token"`       // your Telegram bot token
-	TimeoutSeconds int               `json:"timeout_seconds"` // HTTP timeout
-	AdminID        int64             `json:"admin_id"`        // admin Telegram ID
-	DBPath         string            `json:"db_path"`         // path to the database
-	Debug          bool              `json:"debug"`           // debug mode
-	PrivateKey     string            `json:"private_key"`     // private key
-	ReceivedLimit  int               `json:"received_limit"`  // received messages limit
-	DeliveredLimit int               `json:"delivered_limit"` // delivered messages limit
-	Challenges     map[string]string `json:"challenges"`      // validation challenges
-
-	privateKey *keyset.Handle
-}
-
-func readConfig(path string) *config {
-	file, err := os.Open(filepath.Clean(path))
-	checkErr(err)
-	defer func() { checkErr(file.Close()) }()
-	return parseConfig(file)
+	ListenAddress        string            `json:"listen_address"`         // the address to listen to incoming Telegram messages
+	APIDomain            string            `json:"api_domain"`             // the domain name for API
+	WebhookDomain        string            `json:"webhook_domain"`         // the domain name for the webhook
+	BotToken             string            `json:"bot_token"`              // your Telegram bot token
+	BotAPIEndpoint       string            `json:"bot_api_endpoint"`       // Telegram Bot API endpoint, the official one by default
+	TimeoutSeconds       int               `json:"timeout_seconds"`        // HTTP timeout
+	AdminID              int64             `json:"admin_id"`               // admin Telegram ID, always the owner
+	Admins               []adminConfig     `json:"admins"`                 // other admins and their roles
+	DBPath               string            `json:"db_path"`                // path to the SQLite database
+	DBDSN                string            `json:"db_dsn"`                 // PostgreSQL DSN, overrides db_path
+	Debug                bool              `json:"debug"`                  // debug mode
+	PrivateKey           string            `json:"private_key"`            // private key
+	OldPrivateKeys       []string          `json:"old_private_keys"`       // retired private keys still accepted for decryption
+	MasterKey            string            `json:"master_key"`             // AEAD keyset encrypting private keys
+	MasterKeyPass        string            `json:"master_key_pass"`        // passphrase to derive the master key from
+	ReceivedLimit        int               `json:"received_limit"`         // received messages limit per rolling 24 hours
+	DeliveredLimit       int               `json:"delivered_limit"`        // delivered messages limit per rolling 24 hours
+	ReceivedHourlyLimit  int               `json:"received_hourly_limit"`  // received messages limit per rolling hour, 0 disables the limit
+	DeliveredHourlyLimit int               `json:"delivered_hourly_limit"` // delivered messages limit per rolling hour, 0 disables the limit
+	RequestWindow        int               `json:"request_window"`         // allowed clock skew of v2 requests in seconds
+	KeyDifficulty        int               `json:"key_difficulty"`         // proof of work difficulty of version 2 device keys in bits
+	RejectNewV1Keys      bool              `json:"reject_new_v1_keys"`     // refuse new version 1 device keys once apps mine version 2 keys, known ones are always accepted
+	IPRateLimit          int               `json:"ip_rate_limit"`          // API requests per minute per client IP, 0 disables the limit
+	IPBurst              int               `json:"ip_burst"`               // API requests burst per client IP
+	DeviceLimit          int               `json:"device_limit"`           // API requests per device in a sliding window, 0 disables the limit
+	DeviceWindow         int               `json:"device_window"`          // the sliding window in seconds
+	TrustedProxies       []string          `json:"trusted_proxies"`        // proxies allowed to set X-Forwarded-For
+	DashboardPassword    string            `json:"dashboard_password"`     // web dashboard password, empty disables the dashboard
+	BroadcastRate        int               `json:"broadcast_rate"`         // broadcast messages per second
+	BackupPassword       string            `json:"backup_password"`        // passphrase encrypting backups, empty leaves them unencrypted
+	DeliveryWorkers      int               `json:"delivery_workers"`       // goroutines delivering messages and processing updates concurrently
+	Challenges           map[string]string `json:"challenges"`             // validation challenges
+	TLSCert              string            `json:"tls_cert"`               // TLS certificate file, a self-signed one is uploaded to Telegram
+	TLSKey               string            `json:"tls_key"`                // TLS private key file
+	ACMEHosts            []string          `json:"acme_hosts"`             // hosts to obtain TLS certificates for using ACME
+	ACMEDirectory        string            `json:"acme_directory"`         // ACME directory URL, Let's Encrypt by default
+	ACMECA               string            `json:"acme_ca"`                // CA certificates file to trust for the ACME directory
+	ACMEEmail            string            `json:"acme_email"`             // ACME account contact email
+	ACMECacheDir         string            `json:"acme_cache_dir"`         // directory to store ACME certificates in
+	ACMEHTTPAddress      string            `json:"acme_http_address"`      // the address to serve ACME HTTP challenges on, TLS-ALPN challenges are served anyway
+
+	privateKeys    []*keyset.Handle
+	trustedProxies []*net.IPNet
 }
 
-func parseConfig(r io.Reader) *config {
-	decoder := json.NewDecoder(r)
-	decoder.DisallowUnknownFields()
-	cfg := &config{}
-	err := decoder.Decode(cfg)
-	parseEnv(cfg)
-	checkErr(err)
-	checkErr(checkConfig(cfg))
-	privateKey, err := parsePrivateKey(cfg.PrivateKey)
+// envPrefix is the prefix of environment variables overriding config fields
+const envPrefix = "SMSQ_"
+
+// configField is a config field settable from environment variables and flags
+type configField struct {
+	name  string // JSON name
+	value reflect.Value
+}
+
+func (c *config) fields() (fields []configField) {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields = append(fields, configField{name: name, value: v.Field(i)})
+	}
+	return
+}
+
+func (f configField) env() string { return envPrefix + strings.ToUpper(f.name) }
+
+func (f configField) flag() string { return strings.ReplaceAll(f.name, "_", "-") }
+
+// set parses a string value, lists of strings are comma separated, other composite types are JSON
+func (f configField) set(s string) error {
+	v := f.value
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", s)
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			var items []string
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			v.Set(reflect.ValueOf(items))
+			return nil
+		}
+		fallthrough
+	default:
+		if err := json.Unmarshal([]byte(s), v.Addr().Interface()); err != nil {
+			return fmt.Errorf("%q is not valid JSON for this field, %v", s, err)
+		}
+	}
+	return nil
+}
+
+// readConfig reads the config with the precedence flags > environment > file,
+// the config file is optional and can be passed as a positional argument
+func readConfig(args []string) *config {
+	cfg, err := loadConfig(args)
 	checkErr(err)
-	cfg.privateKey = privateKey
 	return cfg
 }
 
-func parseEnv(config *config) {
-	envVar, ok := os.LookupEnv("DOMAIN")
-	if ok == true {
-		config.WebhookDomain = envVar
-		config.APIDomain = envVar
+func loadConfig(args []string) (*config, error) {
+	cfg, err := parseConfig(args)
+	if err != nil {
+		return nil, err
 	}
+	if err := checkConfig(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, cfg.loadKeys()
+}
 
-	envVar, ok = os.LookupEnv("BOT_TOKEN")
-	if ok == true {
-		config.BotToken = envVar
+// fieldFlag sets a config field after the config file and the environment are read
+type fieldFlag struct {
+	field   configField
+	setters *[]func() error
+}
+
+func (f fieldFlag) String() string { return "" }
+
+func (f fieldFlag) Set(s string) error {
+	*f.setters = append(*f.setters, func() error {
+		if err := f.field.set(s); err != nil {
+			return fmt.Errorf("flag -%s: %v", f.field.flag(), err)
+		}
+		return nil
+	})
+	return nil
+}
+
+// IsBoolFlag lets boolean fields be given without a value
+func (f fieldFlag) IsBoolFlag() bool { return f.field.value.Kind() == reflect.Bool }
+
+// parseConfig reads the config file, the environment and the flags without checking the result
+func parseConfig(args []string) (*config, error) {
+	cfg := &config{}
+	flags := flag.NewFlagSet("smsq", flag.ContinueOnError)
+	path := flags.String("config", os.Getenv(envPrefix+"CONFIG"), "path to the config file (env "+envPrefix+"CONFIG)")
+	var setters []func() error
+	for _, f := range cfg.fields() {
+		flags.Var(fieldFlag{f, &setters}, f.flag(), fmt.Sprintf("sets %s (env %s)", f.name, f.env()))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	switch {
+	case flags.NArg() == 1 && *path == "":
+		*path = flags.Arg(0)
+	case flags.NArg() != 0:
+		return nil, errors.New("usage: smsq [command] [flags] [config]")
+	}
+	if *path != "" {
+		if err := readConfigFile(*path, cfg); err != nil {
+			return nil, fmt.Errorf("config file %s: %v", *path, err)
+		}
+	}
+	if err := parseEnv(cfg); err != nil {
+		return nil, err
+	}
+	for _, set := range setters {
+		if err := set(); err != nil {
+			return nil, err
+		}
 	}
+	return cfg, nil
+}
 
-	envVar, ok = os.LookupEnv("ADMIN_ID")
-	if ok == true {
-		id, _ := strconv.ParseInt(envVar, 10, 64)
-		config.AdminID = id
+func readConfigFile(path string, cfg *config) error {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
 	}
+	defer func() { checkErr(file.Close()) }()
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(cfg)
+}
+
+// loadKeys parses trusted proxies and reads private keys
+func (c *config) loadKeys() error {
+	var err error
+	if c.trustedProxies, err = parseNetworks(c.TrustedProxies); err != nil {
+		return err
+	}
+	masterKey, err := keys.ReadMasterKey(c.MasterKey)
+	if err != nil {
+		return err
+	}
+	for _, file := range append([]string{c.PrivateKey}, c.OldPrivateKeys...) {
+		privateKey, err := keys.ReadPrivateKey(file, masterKey, c.MasterKeyPass)
+		if err != nil {
+			return fmt.Errorf("private key %s: %v", file, err)
+		}
+		c.privateKeys = append(c.privateKeys, privateKey)
+	}
+	return nil
+}
+
+// legacyEnv maps environment variables supported before SMSQ_* ones to config fields
+var legacyEnv = []struct {
+	env    string
+	fields []string
+}{
+	{"DOMAIN", []string{"webhook_domain", "api_domain"}},
+	{"BOT_TOKEN", []string{"bot_token"}},
+	{"ADMIN_ID", []string{"admin_id"}},
+}
+
+// parseEnv applies legacy environment variables and then SMSQ_* ones
+func parseEnv(cfg *config) error {
+	fields := map[string]configField{}
+	for _, f := range cfg.fields() {
+		fields[f.name] = f
+	}
+	for _, legacy := range legacyEnv {
+		envVar, ok := os.LookupEnv(legacy.env)
+		if !ok {
+			continue
+		}
+		for _, name := range legacy.fields {
+			if err := fields[name].set(envVar); err != nil {
+				return fmt.Errorf("%s: %v", legacy.env, err)
+			}
+		}
+	}
+	for _, f := range cfg.fields() {
+		envVar, ok := os.LookupEnv(f.env())
+		if !ok {
+			continue
+		}
+		if err := f.set(envVar); err != nil {
+			return fmt.Errorf("%s: %v", f.env(), err)
+		}
+	}
+	return nil
+}
+
+// redacted returns a copy of the config with secrets masked
+func (c *config) redacted() *config {
+	r := *c
+	mask := func(s *string) {
+		if *s != "" {
+			*s = "***"
+		}
+	}
+	mask(&r.BotToken)
+	mask(&r.MasterKeyPass)
+	mask(&r.DashboardPassword)
+	mask(&r.BackupPassword)
+	r.DBDSN = redactedDSN(r.DBDSN)
+	return &r
+}
+
+var dsnPassword = regexp.MustCompile(`(?i)(password=)('[^']*'|[^\s&]*)`)
+
+// redactedDSN masks the password in a URL or a key=value DSN
+func redactedDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		dsn = u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}***")
+}
+
+const defaultRequestWindow = 5 * time.Minute
+
+// requestWindow returns the allowed clock skew of v2 requests
+func (c *config) requestWindow() time.Duration {
+	if c.RequestWindow == 0 {
+		return defaultRequestWindow
+	}
+	return time.Duration(c.RequestWindow) * time.Second
+}
+
+// keyDifficulty returns the proof of work difficulty of version 2 device keys
+func (c *config) keyDifficulty() int {
+	if c.KeyDifficulty == 0 {
+		return pow.DefaultDifficulty
+	}
+	return c.KeyDifficulty
+}
+
+const defaultBroadcastRate = 20
+
+// broadcastRate returns broadcast messages per second
+func (c *config) broadcastRate() int {
+	if c.BroadcastRate == 0 {
+		return defaultBroadcastRate
+	}
+	return c.BroadcastRate
+}
+
+const defaultDeliveryWorkers = 8
+
+// deliveryWorkers returns the number of goroutines delivering messages
+func (c *config) deliveryWorkers() int {
+	if c.DeliveryWorkers == 0 {
+		return defaultDeliveryWorkers
+	}
+	return c.DeliveryWorkers
 }
 
 func checkConfig(cfg *config) error {
@@ -84,8 +356,8 @@ func checkConfig(cfg *config) error {
 	if cfg.AdminID == 0 {
 		return errors.New("configure admin_id")
 	}
-	if cfg.DBPath == "" {
-		return errors.New("configure db_path")
+	if cfg.DBPath == "" && cfg.DBDSN == "" {
+		return errors.New("configure db_path or db_dsn")
 	}
 	if cfg.APIDomain == "" {
 		return errors.New("configure api_domain")
@@ -96,6 +368,42 @@ func checkConfig(cfg *config) error {
 	if cfg.PrivateKey == "" {
 		return errors.New("configure private_key")
 	}
+	if cfg.MasterKey != "" && cfg.MasterKeyPass != "" {
+		return errors.New("configure either master_key or master_key_pass")
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("configure both tls_cert and tls_key")
+	}
+	if cfg.TLSCert != "" && len(cfg.ACMEHosts) != 0 {
+		return errors.New("configure either tls_cert or acme_hosts")
+	}
+	if len(cfg.ACMEHosts) == 0 && (cfg.ACMEDirectory != "" || cfg.ACMECA != "" || cfg.ACMECacheDir != "" || cfg.ACMEHTTPAddress != "") {
+		return errors.New("configure acme_hosts")
+	}
+	if cfg.RequestWindow < 0 {
+		return errors.New("request_window must not be negative")
+	}
+	if cfg.KeyDifficulty != 0 && (cfg.KeyDifficulty < pow.V1Difficulty || cfg.KeyDifficulty > 32) {
+		return fmt.Errorf("key_difficulty must be between %d and 32", pow.V1Difficulty)
+	}
+	if cfg.IPRateLimit < 0 || cfg.IPBurst < 0 || cfg.IPBurst > 0 && cfg.IPRateLimit == 0 {
+		return errors.New("configure ip_rate_limit and ip_burst")
+	}
+	if cfg.IPRateLimit != 0 && cfg.IPBurst == 0 {
+		return errors.New("configure ip_burst")
+	}
+	if cfg.DeviceLimit < 0 || cfg.DeviceLimit > 0 && cfg.DeviceWindow <= 0 {
+		return errors.New("configure device_limit and device_window")
+	}
+	if cfg.ReceivedHourlyLimit < 0 || cfg.DeliveredHourlyLimit < 0 {
+		return errors.New("hourly limits must not be negative")
+	}
+	if cfg.DeliveryWorkers < 0 {
+		return errors.New("delivery_workers must not be negative")
+	}
+	if cfg.BroadcastRate < 0 || cfg.BroadcastRate > 30 {
+		return errors.New("broadcast_rate must be between 1 and 30")
+	}
 	if cfg.ReceivedLimit == 0 {
 		return errors.New("configure received_limit")
 	}
@@ -104,15 +412,3 @@ func checkConfig(cfg *config) error {
 	}
 	return nil
 }
-
-func parsePrivateKey(file string) (*keyset.Handle, error) {
-	data, err := ioutil.ReadFile(file)
-	if err != nil {
-		return nil, err
-	}
-	kh, err := insecurecleartextkeyset.Read(keyset.NewJSONReader(bytes.NewReader(data)))
-	if err != nil {
-		return nil, err
-	}
-	return kh, nil
-}
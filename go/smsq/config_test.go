@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setEnv sets an environment variable for the duration of a test
+func setEnv(t *testing.T, name, value string) {
+	checkErr(os.Setenv(name, value))
+	t.Cleanup(func() { checkErr(os.Unsetenv(name)) })
+}
+
+func TestParseConfigFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(`{"bot_token": "file", "debug": false}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	setEnv(t, "SMSQ_BOT_TOKEN", "env")
+	setEnv(t, "MASTER_KEY", "legacy")
+	tests := []struct {
+		name  string
+		args  []string
+		check func(cfg *config) bool
+	}{
+		{"bool without a value", []string{"-debug", path}, func(cfg *config) bool { return cfg.Debug && cfg.BotToken == "env" }},
+		{"bool with a value", []string{"-debug=false", "-reject-new-v1-keys", path}, func(cfg *config) bool { return !cfg.Debug && cfg.RejectNewV1Keys }},
+		{"flags override the environment", []string{"-bot-token", "flag", path}, func(cfg *config) bool { return cfg.BotToken == "flag" }},
+		{"no legacy master key", []string{path}, func(cfg *config) bool { return cfg.MasterKey == "" }},
+	}
+	for _, tt := range tests {
+		cfg, err := parseConfig(tt.args)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(cfg) {
+			t.Errorf("%s: unexpected config %+v", tt.name, cfg.redacted())
+		}
+	}
+	if _, err := parseConfig([]string{"-admin-id", "x", path}); err == nil {
+		t.Error("invalid integer flag is accepted")
+	}
+}
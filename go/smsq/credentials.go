@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/tink/go/aead/subtle"
+)
+
+// credentialsRequest is the decrypted payload of a credentials request,
+// ResponseKey is a one-time AES-256 key the secret is encrypted with
+type credentialsRequest struct {
+	Key         string `json:"key"`
+	ResponseKey []byte `json:"response_key"`
+	Rebind      bool   `json:"rebind"`  // lets /start move the device instead of claiming the secret, signed with the secret
+	SentAt      int64  `json:"sent_at"` // rebind client timestamp checked against the request window
+	Nonce       string `json:"nonce"`   // rebind unique request ID protecting from replays
+}
+
+type credentialsResponse struct {
+	Error  *string         `json:"error"`
+	Result *deliveryResult `json:"result"`
+	Secret *string         `json:"secret"`
+}
+
+const secretLength = 32
+
+// claimWindow is how long a device can claim its secret after /start connects it
+const claimWindow = 10 * time.Minute
+
+// rebindWindow is how long /start can move a device after the device allows it
+const rebindWindow = 10 * time.Minute
+
+// newSecret generates a per-device secret
+func newSecret() string {
+	secret := make([]byte, secretLength)
+	_, err := rand.Read(secret)
+	checkErr(err)
+	return base64.StdEncoding.EncodeToString(secret)
+}
+
+// deviceSecret returns the secret of the device and whether the device has claimed it,
+// disconnected devices keep their secrets so that nobody else can connect them by their keys
+func (w *worker) deviceSecret(key string) (secret string, claimed bool, found bool) {
+	query, err := w.db.Query("select secret, secret_claimed from devices where key=?", key)
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	if !query.Next() {
+		return "", false, false
+	}
+	checkErr(query.Scan(&secret, &claimed))
+	return secret, claimed, true
+}
+
+// payloadMAC computes the MAC of a request payload with the device secret
+func payloadMAC(secret string, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// authorized checks the MAC of a request,
+// the MAC is required only for devices which have claimed their secrets
+func (w *worker) authorized(key string, request smsRequest) bool {
+	secret, claimed, found := w.deviceSecret(key)
+	if !found || !claimed {
+		return true
+	}
+	if secret == "" {
+		return false
+	}
+	mac, err := base64.StdEncoding.DecodeString(request.MAC)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(mac, payloadMAC(secret, request.Payload))
+}
+
+// claimSecret hands the secret out once, shortly after /start has connected the device
+func (w *worker) claimSecret(key string) (string, deliveryResult) {
+	secret, claimed, found := w.deviceSecret(key)
+	if !found {
+		return "", userNotFound
+	}
+	// devices registered before secrets have none until the migration gives them one
+	if claimed || secret == "" {
+		return "", unauthorized
+	}
+	result := w.mustExec(`
+		update devices set secret_claimed=1, claim_until=0
+		where key=? and secret=? and secret_claimed=0 and deleted=0 and claim_until>=?`,
+		key,
+		secret,
+		time.Now().Unix())
+	rows, err := result.RowsAffected()
+	checkErr(err)
+	if rows != 1 {
+		return "", unauthorized
+	}
+	return secret, delivered
+}
+
+// allowRebind lets /start move a device which has claimed its secret,
+// the request is signed with the secret as /start cannot carry a MAC
+func (w *worker) allowRebind(credentials credentialsRequest, request smsRequest) deliveryResult {
+	_, claimed, found := w.deviceSecret(credentials.Key)
+	if !found {
+		return userNotFound
+	}
+	if !claimed {
+		return delivered
+	}
+	if !w.authorized(credentials.Key, request) {
+		return unauthorized
+	}
+	if !w.fresh(credentials.SentAt) || !w.storeNonce(credentials.Key, credentials.Nonce) {
+		return badRequest
+	}
+	w.mustExec("update devices set rebind_until=? where key=?", time.Now().Add(rebindWindow).Unix(), credentials.Key)
+	return delivered
+}
+
+func (w *worker) handleV1Credentials(writer http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(writer, "404 not found", http.StatusNotFound)
+		return
+	}
+
+	w.ldbg("got credentials request")
+
+	if !w.allowIP(writer, r) {
+		return
+	}
+
+	var request smsRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		w.ldbg("cannot decode credentials request")
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Version != 1 {
+		lerr("version is not 1")
+		http.Error(writer, "unexpected version", http.StatusBadRequest)
+		return
+	}
+
+	decrypted, _, err := w.decrypt(request.Payload, nil)
+	if err != nil {
+		lerr("decryption error")
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var credentials credentialsRequest
+	err = json.NewDecoder(bytes.NewReader(decrypted)).Decode(&credentials)
+	if err != nil {
+		lerr("cannot decode credentials")
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	if credentials.Rebind {
+		result := w.allowRebind(credentials, request)
+		w.ldbg("rebind result: %v", result)
+		w.credentialsReply(writer, result, nil)
+		return
+	}
+	if len(credentials.ResponseKey) != 32 {
+		w.credentialsReply(writer, badRequest, nil)
+		w.ldbg("invalid response key")
+		return
+	}
+	responseKey, err := subtle.NewAESGCM(credentials.ResponseKey)
+	checkErr(err)
+
+	secret, result := w.claimSecret(credentials.Key)
+	if result != delivered {
+		w.credentialsReply(writer, result, nil)
+		return
+	}
+	encrypted, err := responseKey.Encrypt([]byte(secret), []byte(credentials.Key))
+	checkErr(err)
+	encoded := base64.StdEncoding.EncodeToString(encrypted)
+	w.credentialsReply(writer, delivered, &encoded)
+}
+
+func (w *worker) credentialsReply(writer http.ResponseWriter, result deliveryResult, secret *string) {
+	writer.WriteHeader(http.StatusOK)
+	res := credentialsResponse{Result: &result, Secret: secret}
+	resString, err := json.Marshal(res)
+	checkErr(err)
+	_, err = writer.Write(resString)
+	checkErr(err)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/igrmk/smsq/go/smsq/pow"
+	"github.com/igrmk/smsq/go/smsq/telegram"
+)
+
+// testBot starts a fake Bot API and returns the texts sent to each chat
+func testBot(t *testing.T, w *worker) map[int64][]string {
+	t.Helper()
+	var mu sync.Mutex
+	sent := map[int64][]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		var params telegram.SendMessageParams
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		sent[params.ChatID] = append(sent[params.ChatID], params.Text)
+		mu.Unlock()
+		_, _ = writer.Write([]byte(`{"ok":true,"result":{"message_id":1,"chat":{"id":1,"type":"private"}}}`))
+	}))
+	t.Cleanup(server.Close)
+	w.bot = telegram.New("1:token", server.URL, server.Client())
+	return sent
+}
+
+// signed returns a request carrying the MAC of its payload
+func signed(secret string) smsRequest {
+	return smsRequest{Payload: "payload", MAC: base64.StdEncoding.EncodeToString(payloadMAC(secret, "payload"))}
+}
+
+func TestRegistration(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		w := testWorker(t, d, "test")
+		w.createDatabase()
+		testBot(t, w)
+		key, err := pow.Mine(w.cfg().keyDifficulty())
+		checkErr(err)
+		chat := func() int64 {
+			return int64(singleInt(w.db.QueryRow("select chat_id from devices where key=? and deleted=0", key)))
+		}
+		rebind := func(request smsRequest, nonce string) deliveryResult {
+			return w.allowRebind(credentialsRequest{Key: key, Rebind: true, SentAt: time.Now().Unix(), Nonce: nonce}, request)
+		}
+
+		w.start(1, key)
+		secret, result := w.claimSecret(key)
+		if result != delivered || secret == "" {
+			t.Fatalf("claim = %v", result)
+		}
+		if _, result := w.claimSecret(key); result != unauthorized {
+			t.Errorf("second claim = %v, want unauthorized", result)
+		}
+
+		w.start(2, key)
+		if c := chat(); c != 1 {
+			t.Errorf("device moved by its key to chat %d", c)
+		}
+		if result := rebind(signed("wrong"), "1"); result != unauthorized {
+			t.Errorf("rebind with a wrong MAC = %v, want unauthorized", result)
+		}
+		if result := rebind(signed(secret), "2"); result != delivered {
+			t.Errorf("rebind = %v, want delivered", result)
+		}
+		if result := rebind(signed(secret), "2"); result != badRequest {
+			t.Errorf("replayed rebind = %v, want badRequest", result)
+		}
+		w.start(2, key)
+		if c := chat(); c != 2 {
+			t.Errorf("device is in chat %d after a signed rebind, want 2", c)
+		}
+		if s, claimed, _ := w.deviceSecret(key); s != secret || !claimed {
+			t.Error("the secret is not kept on a rebind")
+		}
+
+		// a rebind is used once
+		w.stop(2)
+		w.start(3, key)
+		if n := singleInt(w.db.QueryRow("select count(*) from devices where key=? and deleted=0", key)); n != 0 {
+			t.Error("a disconnected device is connected by its key")
+		}
+		if !w.authorized(key, signed(secret)) || w.authorized(key, smsRequest{Payload: "payload"}) {
+			t.Error("a disconnected device does not require the MAC")
+		}
+	})
+}
+
+func TestClaimWindow(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		w := testWorker(t, d, "test")
+		w.createDatabase()
+		testBot(t, w)
+		key, err := pow.Mine(w.cfg().keyDifficulty())
+		checkErr(err)
+
+		w.start(1, key)
+		w.mustExec("update devices set claim_until=? where key=?", time.Now().Add(-time.Second).Unix(), key)
+		if _, result := w.claimSecret(key); result != unauthorized {
+			t.Errorf("claim after the window = %v, want unauthorized", result)
+		}
+		if !w.authorized(key, smsRequest{Payload: "payload"}) {
+			t.Error("a device without a claimed secret requires the MAC")
+		}
+
+		// moving an unclaimed device keeps its secret
+		secret, _, _ := w.deviceSecret(key)
+		w.start(2, key)
+		if s, _, _ := w.deviceSecret(key); s != secret {
+			t.Error("the secret is changed on a move")
+		}
+		if _, result := w.claimSecret(key); result != delivered {
+			t.Errorf("claim after /start = %v, want delivered", result)
+		}
+	})
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed" // embeds the dashboard template
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed dashboard.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+const dashboardRows = 100
+
+type dashboardStat struct {
+	Name  string
+	Value int
+}
+
+type dashboardUser struct {
+	ChatID    int64
+	Devices   int
+	Delivered int
+	Status    string
+}
+
+type dashboardDevice struct {
+	Key       string
+	ChatID    int64
+	Name      string
+	Delivered int
+	Quota     quota
+	LastSeen  string
+	Status    string
+}
+
+type dashboardResults struct {
+	Hour   string
+	Counts []int
+}
+
+type dashboardFeedback struct {
+	Time   string
+	ChatID int64
+	Text   string
+}
+
+type dashboardData struct {
+	Version     string
+	Message     string
+	CSRF        string
+	Stats       []dashboardStat
+	Users       []dashboardUser
+	Devices     []dashboardDevice
+	ResultNames []string
+	Results     []dashboardResults
+	Feedbacks   []dashboardFeedback
+	Config      string
+}
+
+// countResult counts API results per hour
+func (w *worker) countResult(result deliveryResult) {
+	w.mustExec(`
+		insert into results (hour, result, count) values (?, ?, 1)
+		on conflict(hour, result) do update set count=results.count+1`,
+		time.Now().Truncate(time.Hour).Unix(),
+		result.String())
+}
+
+func (w *worker) csrfToken() string {
+	mac := hmac.New(sha256.New, []byte(w.cfg().DashboardPassword))
+	_, _ = mac.Write([]byte("csrf"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *worker) dashboardPassword(r *http.Request) (string, bool) {
+	if bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); bearer != r.Header.Get("Authorization") {
+		return bearer, true
+	}
+	_, password, ok := r.BasicAuth()
+	return password, ok
+}
+
+// dashboardAuth requires the dashboard password in the basic auth or as a bearer token,
+// forms must also carry the CSRF token unless a bearer token is used
+func (w *worker) dashboardAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		password, ok := w.dashboardPassword(r)
+		if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(w.cfg().DashboardPassword)) != 1 {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="smsq"`)
+			http.Error(writer, "401 unauthorized", http.StatusUnauthorized)
+			return
+		}
+		bearer := strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if r.Method == "POST" && !bearer && subtle.ConstantTimeCompare([]byte(r.FormValue("csrf")), []byte(w.csrfToken())) != 1 {
+			http.Error(writer, "403 forbidden", http.StatusForbidden)
+			return
+		}
+		next(writer, r)
+	}
+}
+
+func (w *worker) dashboardUsers() (users []dashboardUser) {
+	query, err := w.db.Query(`
+		select chat_id, count(*), sum(delivered) from devices
+		where deleted=0 group by chat_id order by sum(delivered) desc limit ?`,
+		dashboardRows)
+	checkErr(err)
+	for query.Next() {
+		var u dashboardUser
+		checkErr(query.Scan(&u.ChatID, &u.Devices, &u.Delivered))
+		users = append(users, u)
+	}
+	checkErr(query.Close())
+	for i, u := range users {
+		var status []string
+		if w.chatBanned(u.ChatID) {
+			status = append(status, "banned")
+		}
+		if w.chatBlocked(u.ChatID) {
+			status = append(status, "blocked the bot")
+		}
+		users[i].Status = strings.Join(status, ", ")
+	}
+	return
+}
+
+func (w *worker) dashboardDevices() (devices []dashboardDevice) {
+	query, err := w.db.Query(`
+		select key, chat_id, name, delivered, daily_limit, last_seen from devices
+		where deleted=0 order by last_seen desc limit ?`,
+		dashboardRows)
+	checkErr(err)
+	var dailyLimits []int
+	var lastSeen []int64
+	for query.Next() {
+		var d dashboardDevice
+		var dailyLimit int
+		var seen int64
+		checkErr(query.Scan(&d.Key, &d.ChatID, &d.Name, &d.Delivered, &dailyLimit, &seen))
+		devices = append(devices, d)
+		dailyLimits = append(dailyLimits, dailyLimit)
+		lastSeen = append(lastSeen, seen)
+	}
+	checkErr(query.Close())
+	now := time.Now()
+	for i, d := range devices {
+		devices[i].Quota = w.quota(w.db, d.Key, dailyLimits[i], now)
+		devices[i].LastSeen = formatTime(lastSeen[i])
+		if w.keyBanned(d.Key) {
+			devices[i].Status = "banned"
+		}
+	}
+	return
+}
+
+func (w *worker) dashboardResults() ([]string, []dashboardResults) {
+	names := []string{}
+	for r := delivered; r <= unauthorized; r++ {
+		names = append(names, r.String())
+	}
+	now := time.Now().Truncate(time.Hour)
+	counts := map[int64]map[string]int{}
+	query, err := w.db.Query("select hour, result, count from results where hour>? order by hour", now.Add(-dayWindow).Unix())
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	for query.Next() {
+		var hour int64
+		var result string
+		var count int
+		checkErr(query.Scan(&hour, &result, &count))
+		if counts[hour] == nil {
+			counts[hour] = map[string]int{}
+		}
+		counts[hour][result] = count
+	}
+	var results []dashboardResults
+	for hour := now.Add(-dayWindow + time.Hour); !hour.After(now); hour = hour.Add(time.Hour) {
+		row := dashboardResults{Hour: hour.UTC().Format("2006-01-02 15:04")}
+		for _, name := range names {
+			row.Counts = append(row.Counts, counts[hour.Unix()][name])
+		}
+		results = append(results, row)
+	}
+	return names, results
+}
+
+func (w *worker) dashboardFeedbacks() (feedbacks []dashboardFeedback) {
+	query, err := w.db.Query("select chat_id, text, created from feedback order by created desc limit ?", dashboardRows)
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	for query.Next() {
+		var f dashboardFeedback
+		var created int64
+		checkErr(query.Scan(&f.ChatID, &f.Text, &created))
+		f.Time = formatTime(created)
+		feedbacks = append(feedbacks, f)
+	}
+	return
+}
+
+func (w *worker) handleDashboard(writer http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" || r.URL.Path != "/admin/" {
+		http.Error(writer, "404 not found", http.StatusNotFound)
+		return
+	}
+	cfgString, err := json.MarshalIndent(w.cfg().redacted(), "", "    ")
+	checkErr(err)
+	data := dashboardData{
+		Version: version,
+		Message: r.URL.Query().Get("message"),
+		CSRF:    w.csrfToken(),
+		Stats: []dashboardStat{
+			{"users", w.userCount()},
+			{"devices", w.deviceCountTotal()},
+			{"active users", w.activeUserCount()},
+			{"blocked users", w.blockedUserCount()},
+			{"smses", w.smsCount()},
+			{"smses in 24h", w.deliveredTotal(time.Now(), dayWindow)},
+		},
+		Users:     w.dashboardUsers(),
+		Devices:   w.dashboardDevices(),
+		Feedbacks: w.dashboardFeedbacks(),
+		Config:    string(cfgString),
+	}
+	data.ResultNames, data.Results = w.dashboardResults()
+	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(writer, data); err != nil {
+		lerr("cannot render dashboard, %v", err)
+	}
+}
+
+func dashboardRedirect(writer http.ResponseWriter, r *http.Request, message string) {
+	http.Redirect(writer, r, "/admin/?message="+url.QueryEscape(message), http.StatusSeeOther)
+}
+
+func (w *worker) handleDashboardLimit(writer http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(writer, "404 not found", http.StatusNotFound)
+		return
+	}
+	chatID, err := strconv.ParseInt(r.FormValue("chat_id"), 10, 64)
+	if err != nil {
+		dashboardRedirect(writer, r, "Chat ID is invalid")
+		return
+	}
+	limit, err := strconv.ParseInt(r.FormValue("limit"), 10, 64)
+	if err != nil {
+		dashboardRedirect(writer, r, "Limit is invalid")
+		return
+	}
+	if !w.setLimit(chatID, limit) {
+		dashboardRedirect(writer, r, "User not found")
+		return
+	}
+	linf("dashboard: limit of %d set to %d", chatID, limit)
+	dashboardRedirect(writer, r, fmt.Sprintf("Limit of %d set to %d", chatID, limit))
+}
+
+func (w *worker) handleDashboardBan(banned bool) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(writer, "404 not found", http.StatusNotFound)
+			return
+		}
+		target := strings.TrimSpace(r.FormValue("target"))
+		if target == "" {
+			dashboardRedirect(writer, r, "Chat ID or key is required")
+			return
+		}
+		w.setBanned(target, banned)
+		action := "unbanned"
+		if banned {
+			action = "banned"
+		}
+		linf("dashboard: %s %s", target, action)
+		dashboardRedirect(writer, r, fmt.Sprintf("%s %s", target, action))
+	}
+}
+
+func (w *worker) handleDashboardEndpoints() {
+	if w.cfg().DashboardPassword == "" {
+		return
+	}
+	http.HandleFunc("/admin/", w.dashboardAuth(w.handleDashboard))
+	http.HandleFunc("/admin/limit", w.dashboardAuth(w.handleDashboardLimit))
+	http.HandleFunc("/admin/ban", w.dashboardAuth(w.handleDashboardBan(true)))
+	http.HandleFunc("/admin/unban", w.dashboardAuth(w.handleDashboardBan(false)))
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"regexp"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type dialect int
+
+const (
+	sqlite dialect = iota
+	postgres
+)
+
+func (d dialect) String() string {
+	switch d {
+	case sqlite:
+		return "sqlite3"
+	case postgres:
+		return "postgres"
+	default:
+		return "undefined"
+	}
+}
+
+// forUpdate locks selected rows until the end of the transaction,
+// SQLite transactions lock the whole database when they begin instead
+func (d dialect) forUpdate() string {
+	if d == postgres {
+		return " for update"
+	}
+	return ""
+}
+
+// serialPrimaryKey is the type of an auto incremented primary key
+func (d dialect) serialPrimaryKey() string {
+	if d == postgres {
+		return "bigserial primary key"
+	}
+	return "integer primary key"
+}
+
+var integerType = regexp.MustCompile(`(?i)\binteger\b`)
+
+// rewrite adapts a query written for SQLite to the dialect,
+// Postgres gets numbered placeholders and 64-bit integer columns as chat IDs do not fit 32 bits
+func (d dialect) rewrite(query string) string {
+	if d != postgres {
+		return query
+	}
+	trimmed := strings.ToLower(strings.TrimSpace(query))
+	if strings.HasPrefix(trimmed, "create") || strings.HasPrefix(trimmed, "alter") {
+		query = integerType.ReplaceAllString(query, "bigint")
+	}
+	var b strings.Builder
+	n := 0
+	quoted := false
+	for _, c := range query {
+		switch {
+		case c == '\'':
+			quoted = !quoted
+		case c == '?' && !quoted:
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// querier is a database or a transaction
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func mustExecIn(q querier, query string, args ...interface{}) sql.Result {
+	result, err := q.Exec(query, args...)
+	checkErr(err)
+	return result
+}
+
+// database rewrites queries for its dialect
+type database struct {
+	*sql.DB
+	dialect dialect
+}
+
+const sqliteParams = "_txlock=immediate&_journal_mode=WAL&_busy_timeout=10000"
+
+// openDatabase opens PostgreSQL if the DSN is configured and SQLite otherwise
+func openDatabase(cfg *config) *database {
+	d, source := sqlite, cfg.DBPath
+	// WAL and the busy timeout let concurrent workers write without failing on locks
+	if strings.Contains(source, "?") {
+		source += "&" + sqliteParams
+	} else {
+		source += "?" + sqliteParams
+	}
+	if cfg.DBDSN != "" {
+		d, source = postgres, cfg.DBDSN
+	}
+	db, err := sql.Open(d.String(), source)
+	checkErr(err)
+	return &database{DB: db, dialect: d}
+}
+
+func (d *database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return d.DB.Exec(d.dialect.rewrite(query), args...)
+}
+
+func (d *database) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return d.DB.Query(d.dialect.rewrite(query), args...)
+}
+
+func (d *database) QueryRow(query string, args ...interface{}) *sql.Row {
+	return d.DB.QueryRow(d.dialect.rewrite(query), args...)
+}
+
+func (d *database) Prepare(query string) (*sql.Stmt, error) {
+	return d.DB.Prepare(d.dialect.rewrite(query))
+}
+
+func (d *database) Begin() (*transaction, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &transaction{Tx: tx, dialect: d.dialect}, nil
+}
+
+// transaction rewrites queries for its dialect
+type transaction struct {
+	*sql.Tx
+	dialect dialect
+}
+
+func (t *transaction) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return t.Tx.Exec(t.dialect.rewrite(query), args...)
+}
+
+func (t *transaction) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	return t.Tx.Query(t.dialect.rewrite(query), args...)
+}
+
+func (t *transaction) QueryRow(query string, args ...interface{}) *sql.Row {
+	return t.Tx.QueryRow(t.dialect.rewrite(query), args...)
+}
+
+func (t *transaction) Prepare(query string) (*sql.Stmt, error) {
+	return t.Tx.Prepare(t.dialect.rewrite(query))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/igrmk/smsq/go/smsq/pow"
+	"github.com/igrmk/smsq/go/smsq/telegram"
+)
+
+// testDSNEnv is a PostgreSQL database for storage tests, they run on SQLite only if it is not set
+const testDSNEnv = "SMSQ_TEST_DB_DSN"
+
+// testRequirePostgresEnv fails PostgreSQL tests without a database instead of skipping them,
+// scripts/test-go sets it along with a database it starts
+const testRequirePostgresEnv = "SMSQ_TEST_REQUIRE_POSTGRES"
+
+// withSearchPath adds the schema search path to a URL or a key=value DSN
+func withSearchPath(dsn string, schema string) string {
+	switch {
+	case !strings.Contains(dsn, "://"):
+		return dsn + " search_path=" + schema
+	case strings.Contains(dsn, "?"):
+		return dsn + "&search_path=" + schema
+	default:
+		return dsn + "?search_path=" + schema
+	}
+}
+
+// testDatabase opens an empty database of the dialect, Postgres tests get a schema dropped afterwards
+func testDatabase(t *testing.T, d dialect) *config {
+	t.Helper()
+	if d == sqlite {
+		return &config{DBPath: filepath.Join(t.TempDir(), "smsq.db")}
+	}
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		if os.Getenv(testRequirePostgresEnv) != "" {
+			t.Fatal(testDSNEnv + " is not set while " + testRequirePostgresEnv + " is")
+		}
+		t.Skip(testDSNEnv + " is not set")
+	}
+	admin, err := sql.Open("postgres", dsn)
+	checkErr(err)
+	schema := fmt.Sprintf("smsq_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec("create schema " + schema)
+	checkErr(err)
+	t.Cleanup(func() {
+		_, err := admin.Exec("drop schema " + schema + " cascade")
+		checkErr(err)
+		checkErr(admin.Close())
+	})
+	return &config{DBDSN: withSearchPath(dsn, schema)}
+}
+
+// testWorker returns a worker of an empty database without applied migrations
+func testWorker(t *testing.T, d dialect, instanceID string) *worker {
+	t.Helper()
+	cfg := testDatabase(t, d)
+	cfg.ReceivedLimit = 5
+	cfg.DeliveredLimit = 3
+	w := &worker{db: openDatabase(cfg), instanceID: instanceID}
+	t.Cleanup(func() { checkErr(w.db.Close()) })
+	w.cfgValue.Store(cfg)
+	return w
+}
+
+// forEachDialect runs a storage test against SQLite and Postgres
+func forEachDialect(t *testing.T, test func(t *testing.T, d dialect)) {
+	for _, d := range []dialect{sqlite, postgres} {
+		d := d
+		t.Run(d.String(), func(t *testing.T) { test(t, d) })
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	tests := []struct {
+		dialect dialect
+		query   string
+		want    string
+	}{
+		{sqlite, "select * from devices where key=? and chat_id=?", "select * from devices where key=? and chat_id=?"},
+		{sqlite, "create table t (id integer)", "create table t (id integer)"},
+		{postgres, "select * from devices where key=? and chat_id=?", "select * from devices where key=$1 and chat_id=$2"},
+		{postgres, "update t set text='?' where id=?", "update t set text='?' where id=$1"},
+		{postgres, "\n\t\tcreate table t (id integer primary key, n INTEGER)", "\n\t\tcreate table t (id bigint primary key, n bigint)"},
+		{postgres, "alter table t add n integer not null default 0", "alter table t add n bigint not null default 0"},
+		{postgres, "select cast(? as integer)", "select cast($1 as integer)"},
+	}
+	for _, tt := range tests {
+		if got := tt.dialect.rewrite(tt.query); got != tt.want {
+			t.Errorf("%v rewrite(%q) = %q, want %q", tt.dialect, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestUpserts(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		w := testWorker(t, d, "test")
+		w.createDatabase()
+		now := time.Now()
+		for i := 0; i < 2; i++ {
+			count(w.db, "key", now, counterReceived)
+			w.countKeyUsage(7)
+			w.countResult(delivered)
+		}
+		received, _ := windowCounters(w.db, "key", now, dayWindow)
+		tests := []struct {
+			name string
+			got  int
+		}{
+			{"counters", received},
+			{"key_usage", singleInt(w.db.QueryRow("select requests from key_usage where key_id=7"))},
+			{"results", singleInt(w.db.QueryRow("select count from results where result=?", delivered.String()))},
+		}
+		for _, tt := range tests {
+			if tt.got != 2 {
+				t.Errorf("%s = %d, want 2", tt.name, tt.got)
+			}
+		}
+	})
+}
+
+func TestAdmit(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		w := testWorker(t, d, "test")
+		w.createDatabase()
+		w.mustExec("insert into devices (key, chat_id, daily_limit) values ('key', 1, 2)")
+		now := time.Now()
+		tests := []struct {
+			ok      bool
+			limited bool
+		}{
+			{true, false},
+			{true, false},
+			{false, true},  // delivered limit
+			{false, true},  // delivered limit
+			{false, true},  // delivered limit
+			{false, false}, // received limit, no notification
+		}
+		for i, tt := range tests {
+			limit, ok := w.admit("key", 2, now)
+			if ok != tt.ok || (limit != "") != tt.limited {
+				t.Errorf("message %d: admit = %q, %v", i, limit, ok)
+			}
+		}
+		q := w.quota(w.db, "key", 2, now)
+		if q.dayDelivered != 2 {
+			t.Errorf("delivered = %d, want 2", q.dayDelivered)
+		}
+		if rateLimited := singleInt(w.db.QueryRow("select rate_limited from counters where key='key'")); rateLimited != 4 {
+			t.Errorf("rate limited = %d, want 4", rateLimited)
+		}
+	})
+}
+
+func TestAdmitRollsBack(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		w := testWorker(t, d, "test")
+		w.createDatabase()
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("admitting a missing device did not panic")
+				}
+			}()
+			w.admit("missing", 0, time.Now())
+		}()
+		// the failed transaction holds no lock
+		w.mustExec("insert into devices (key, chat_id) values ('key', 1)")
+		if _, ok := w.admit("key", w.cfg().DeliveredLimit, time.Now()); !ok {
+			t.Error("message is not admitted after a failed transaction")
+		}
+	})
+}
+
+func TestStatsSince(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		w := testWorker(t, d, "test")
+		w.createDatabase()
+		now := time.Now()
+		old := day(now) - 3*int64(dayWindow/time.Second)
+		w.mustExec("insert into devices (key, chat_id) values ('mine', 1), ('other', 2)")
+		w.mustExec("insert into daily_stats (day, key, delivered) values (?, 'mine', 4), (?, 'other', 5), (?, ?, 9)", old, old, old, globalStatsKey)
+		count(w.db, "mine", now, counterDelivered)
+		count(w.db, "other", now, counterDelivered)
+		devices := "key in (select key from devices where chat_id=? and deleted=0)"
+		tests := []struct {
+			name  string
+			stats []dayStats
+			want  []dayStats
+		}{
+			{"usage", w.statsSince(old, now, devices, devices, 1), []dayStats{{day: old, delivered: 4}, {day: day(now), delivered: 1}}},
+			{"global", w.statsSince(old, now, "key=?", "key!=?", globalStatsKey), []dayStats{{day: old, delivered: 9}, {day: day(now), delivered: 2}}},
+			{"today", w.statsSince(day(now), now, devices, devices, 1), []dayStats{{day: day(now), delivered: 1}}},
+			{"no devices", w.statsSince(old, now, devices, devices, 3), nil},
+		}
+		for _, tt := range tests {
+			if !reflect.DeepEqual(tt.stats, tt.want) {
+				t.Errorf("%s: stats = %+v, want %+v", tt.name, tt.stats, tt.want)
+			}
+		}
+		if n := singleInt(w.db.QueryRow("select count(*) from daily_stats where day>?", old)); n != 0 {
+			t.Errorf("reading stats rolled up %d rows", n)
+		}
+	})
+}
+
+func TestLeases(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		first := testWorker(t, d, "first")
+		first.createDatabase()
+		second := &worker{db: first.db, instanceID: "second"}
+		second.cfgValue.Store(first.cfg())
+		now := time.Now()
+		tests := []struct {
+			name string
+			w    *worker
+			now  time.Time
+			want bool
+		}{
+			{"acquire", first, now, true},
+			{"renew", first, now.Add(leaseRenewal), true},
+			{"held", second, now.Add(leaseRenewal), false},
+			{"expired", second, now.Add(leaseRenewal + leaseDuration + time.Second), true},
+			{"taken over", first, now.Add(leaseRenewal + leaseDuration + time.Second), false},
+		}
+		for _, tt := range tests {
+			if got := tt.w.acquireLease(leaderLease, tt.now); got != tt.want {
+				t.Errorf("%s: acquireLease = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+		first.acquireLease(instanceLease(first.instanceID), now)
+		second.acquireLease(instanceLease(second.instanceID), now)
+		if n := first.otherInstances(now); n != 1 {
+			t.Errorf("other instances = %d, want 1", n)
+		}
+		second.releaseLease(instanceLease(second.instanceID))
+		if n := runningInstances(first.db, now); n != 1 {
+			t.Errorf("running instances = %d, want 1", n)
+		}
+	})
+}
+
+func TestElectRetriesWebhook(t *testing.T) {
+	w := testWorker(t, sqlite, "test")
+	w.createDatabase()
+	failures := 1
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/setWebhook") && failures > 0:
+			failures--
+			_, _ = writer.Write([]byte(`{"ok":false,"error_code":502,"description":"Bad Gateway"}`))
+		case strings.HasSuffix(r.URL.Path, "/getWebhookInfo"):
+			_, _ = writer.Write([]byte(`{"ok":true,"result":{"url":""}}`))
+		default:
+			_, _ = writer.Write([]byte(`{"ok":true,"result":true}`))
+		}
+	}))
+	defer server.Close()
+	w.bot = telegram.New("1:token", server.URL, server.Client())
+	w.elect()
+	if !w.leader || w.webhookSet {
+		t.Fatalf("leader = %v, webhook set = %v after a failure", w.leader, w.webhookSet)
+	}
+	w.elect()
+	if !w.webhookSet {
+		t.Error("the webhook is not set on the next election")
+	}
+}
+
+func TestCreateDatabase(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		w := testWorker(t, d, "test")
+		w.createDatabase()
+		if v := schemaVersion(w.db); v != latestVersion() {
+			t.Errorf("schema version = %d, want %d", v, latestVersion())
+		}
+		if m := w.verifyChecksums(); len(m) != 0 {
+			t.Errorf("checksum mismatches %v", m)
+		}
+		// another instance starting finds nothing to do
+		w.createDatabase()
+		id := singleInt64(w.db.QueryRow(
+			"insert into broadcasts (admin_id, text, status, created) values (1, 'text', 'done', 0) returning id"))
+		if id != 1 {
+			t.Errorf("broadcast id = %d, want 1", id)
+		}
+	})
+}
+
+func TestCheckKey(t *testing.T) {
+	w := testWorker(t, sqlite, "test")
+	w.createDatabase()
+	v1, err := pow.MineV1()
+	checkErr(err)
+	v2, err := pow.Mine(w.cfg().keyDifficulty())
+	checkErr(err)
+	if !w.checkKey(v2) {
+		t.Error("version 2 key is rejected")
+	}
+	if !w.checkKey(v1) {
+		t.Error("version 1 key is rejected by default")
+	}
+	w.cfg().RejectNewV1Keys = true
+	if w.checkKey(v1) {
+		t.Error("new version 1 key is accepted")
+	}
+	w.mustExec("insert into devices (key, chat_id, deleted) values (?, 1, 1)", v1)
+	if !w.checkKey(v1) {
+		t.Error("known version 1 key is rejected")
+	}
+}
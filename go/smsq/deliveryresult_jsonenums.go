@@ -16,6 +16,7 @@ var (
 		"userNotFound": userNotFound,
 		"apiRetired":   apiRetired,
 		"rateLimited":  rateLimited,
+		"unauthorized": unauthorized,
 	}
 
 	_deliveryResultValueToName = map[deliveryResult]string{
@@ -26,6 +27,7 @@ var (
 		userNotFound: "userNotFound",
 		apiRetired:   "apiRetired",
 		rateLimited:  "rateLimited",
+		unauthorized: "unauthorized",
 	}
 )
 
@@ -40,6 +42,7 @@ func init() {
 			interface{}(userNotFound).(fmt.Stringer).String(): userNotFound,
 			interface{}(apiRetired).(fmt.Stringer).String():   apiRetired,
 			interface{}(rateLimited).(fmt.Stringer).String():  rateLimited,
+			interface{}(unauthorized).(fmt.Stringer).String(): unauthorized,
 		}
 	}
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/igrmk/smsq/go/smsq/telegram"
+)
+
+// maxTopicName is the maximum length of a forum topic name
+const maxTopicName = 128
+
+// ownedForum checks if the message is sent to a forum supergroup by its creator
+func (w *worker) ownedForum(m *telegram.Message) bool {
+	if m.Chat.Type != "supergroup" || !m.Chat.IsForum || m.From == nil {
+		return false
+	}
+	member, err := w.bot.GetChatMember(m.Chat.ID, m.From.ID)
+	if err != nil {
+		lerr("cannot get chat member %d of %d, %v", m.From.ID, m.Chat.ID, err)
+		return false
+	}
+	if member.Status != "creator" {
+		return false
+	}
+	w.mustExec("insert into forum_chats (chat_id) values (?) on conflict(chat_id) do nothing", m.Chat.ID)
+	return true
+}
+
+// forumChat returns whether the chat is a forum and whether its topics are per SIM
+func (w *worker) forumChat(chatID int64) (forum bool, perSIM bool) {
+	err := w.db.QueryRow("select per_sim from forum_chats where chat_id=?", chatID).Scan(&perSIM)
+	if err == sql.ErrNoRows {
+		return false, false
+	}
+	checkErr(err)
+	return true, perSIM
+}
+
+func (w *worker) deviceName(key string) string {
+	var name string
+	checkErr(w.db.QueryRow("select name from devices where key=?", key).Scan(&name))
+	if name == "" {
+		name = "Device " + key[:8]
+	}
+	return name
+}
+
+func topicSIM(sms sms) string {
+	if sms.SIM != "" {
+		return sms.SIM
+	}
+	return sms.Carrier
+}
+
+// topic returns the thread to deliver the SMS to creating it if needed, 0 means no thread
+func (w *worker) topic(chatID int64, sms sms) int {
+	forum, perSIM := w.forumChat(chatID)
+	if !forum {
+		return 0
+	}
+	sim := ""
+	if perSIM {
+		sim = topicSIM(sms)
+	}
+	var threadID int
+	err := w.db.QueryRow("select thread_id from topics where chat_id=? and key=? and sim=?", chatID, sms.Key, sim).Scan(&threadID)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+		return threadID
+	}
+	name := w.deviceName(sms.Key)
+	if sim != "" {
+		name += " " + sim
+	}
+	if runes := []rune(name); len(runes) > maxTopicName {
+		name = string(runes[:maxTopicName])
+	}
+	topic, err := w.bot.CreateForumTopic(chatID, name)
+	if err != nil {
+		lerr("cannot create a topic in %d, %v", chatID, err)
+		return 0
+	}
+	w.mustExec("insert into topics (chat_id, key, sim, thread_id) values (?, ?, ?, ?)", chatID, sms.Key, sim, topic.MessageThreadID)
+	return topic.MessageThreadID
+}
+
+// threadNotFound checks if the topic has been deleted
+func threadNotFound(err error) bool {
+	tgErr, ok := err.(telegram.Error)
+	return ok && tgErr.Code == 400 && strings.Contains(strings.ToLower(tgErr.Description), "thread not found")
+}
+
+// sendToTopic sends the SMS to its topic recreating the topic if it has been deleted
+func (w *worker) sendToTopic(chatID int64, sms sms, text string) error {
+	threadID := w.topic(chatID, sms)
+	err := w.sendThreadText(chatID, threadID, true, parseHTML, text)
+	if threadID == 0 || !threadNotFound(err) {
+		return err
+	}
+	linf("topic %d in %d is deleted, recreating", threadID, chatID)
+	w.mustExec("delete from topics where chat_id=? and thread_id=?", chatID, threadID)
+	return w.sendThreadText(chatID, w.topic(chatID, sms), true, parseHTML, text)
+}
+
+// topics switches topics between per device and per SIM
+func (w *worker) topics(chatID int64, arguments string) {
+	if forum, _ := w.forumChat(chatID); !forum {
+		_ = w.sendText(chatID, false, parseRaw, "Topics work only in a forum supergroup")
+		return
+	}
+	perSIM := 0
+	switch arguments {
+	case "device":
+	case "sim":
+		perSIM = 1
+	default:
+		_ = w.sendText(chatID, false, parseRaw, "Usage: /topics device|sim")
+		return
+	}
+	w.mustExec("update forum_chats set per_sim=? where chat_id=?", perSIM, chatID)
+	_ = w.sendText(chatID, false, parseRaw, "OK")
+}
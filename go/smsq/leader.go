@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// Instances sharing the database elect a leader holding a lease in the database.
+// The leader owns the webhook and runs periodic jobs and broadcasts,
+// every instance serves the API and webhook requests.
+const (
+	leaseDuration = 3 * time.Minute
+	leaseRenewal  = time.Minute
+	leaderLease   = "leader"
+)
+
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "smsq"
+	}
+	return host + "-" + randomHex(4)
+}
+
+func instanceLease(id string) string { return "instance:" + id }
+
+// acquireLease takes or renews a lease unless another instance holds it
+func (w *worker) acquireLease(name string, now time.Time) bool {
+	result := w.mustExec(`
+		insert into leases (name, owner, expires) values (?, ?, ?)
+		on conflict(name) do update set owner=excluded.owner, expires=excluded.expires
+		where leases.owner=excluded.owner or leases.expires<?`,
+		name,
+		w.instanceID,
+		now.Add(leaseDuration).Unix(),
+		now.Unix())
+	rows, err := result.RowsAffected()
+	checkErr(err)
+	return rows == 1
+}
+
+func (w *worker) releaseLease(name string) {
+	w.mustExec("delete from leases where name=? and owner=?", name, w.instanceID)
+}
+
+// otherInstances returns the number of other instances alive
+func (w *worker) otherInstances(now time.Time) int {
+	return singleInt(w.db.QueryRow(
+		"select count(*) from leases where name like 'instance:%' and owner!=? and expires>=?",
+		w.instanceID,
+		now.Unix()))
+}
+
+// runningInstances returns the number of instances alive,
+// databases created before leases cannot tell and return 0
+func runningInstances(db *database, now time.Time) int {
+	var running int
+	err := db.QueryRow("select count(*) from leases where name like 'instance:%' and expires>=?", now.Unix()).Scan(&running)
+	if err != nil {
+		return 0
+	}
+	return running
+}
+
+// elect renews the leases of this instance and takes over the leadership if it is free
+func (w *worker) elect() {
+	now := time.Now()
+	w.acquireLease(instanceLease(w.instanceID), now)
+	leader := w.acquireLease(leaderLease, now)
+	switch {
+	case leader && !w.leader:
+		linf("instance %s is the leader", w.instanceID)
+		w.leader = true
+		w.webhookSet = false
+		w.resumeBroadcasts()
+	case !leader && w.leader:
+		linf("instance %s lost the leadership", w.instanceID)
+		w.leader = false
+	}
+	// a failure of Telegram during a failover must not take the new leader down
+	if w.leader && !w.webhookSet {
+		if err := w.setWebhook(); err != nil {
+			lerr("cannot set the webhook, retrying on the next lease renewal, %v", err)
+			return
+		}
+		w.webhookSet = true
+	}
+}
+
+// shutdown hands the leadership over, the last instance removes the webhook
+func (w *worker) shutdown() {
+	w.releaseLease(instanceLease(w.instanceID))
+	if w.leader {
+		w.releaseLease(leaderLease)
+	}
+	if n := w.otherInstances(time.Now()); n != 0 {
+		linf("keeping the webhook for %d other instance(s)", n)
+		return
+	}
+	w.removeWebhook()
+}
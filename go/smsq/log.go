@@ -10,7 +10,7 @@ func linf(format string, v ...interface{}) { log.Printf("[INFO] "+format, v...)
 
 // ldbg logs a debug message
 func (w *worker) ldbg(format string, v ...interface{}) {
-	if w.cfg.Debug {
+	if w.cfg().Debug {
 		log.Printf("[DEBUG] "+format, v...)
 	}
 }
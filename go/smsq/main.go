@@ -2,9 +2,9 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,17 +12,18 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unicode/utf8"
 
-	tg "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/google/tink/go/hybrid"
 	"github.com/google/tink/go/tink"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/igrmk/smsq/go/smsq/pow"
+	"github.com/igrmk/smsq/go/smsq/telegram"
 )
 
 const version = "1.7.0"
@@ -39,6 +40,8 @@ func checkErr(err error) {
 type smsRequest struct {
 	Payload string
 	Version int
+	Key     string // device key in the clear, v2 ciphertexts are bound to it
+	MAC     string // payload MAC with the device secret, required once the secret is claimed
 }
 
 type sms struct {
@@ -51,8 +54,12 @@ type sms struct {
 	Sender    string `json:"sender"`
 	Timestamp int64  `json:"timestamp"`
 	Offset    int    `json:"offset"`
+	SentAt    int64  `json:"sent_at"` // v2 client timestamp checked against the request window
+	Nonce     string `json:"nonce"`   // v2 unique request ID protecting from replays
 }
 
+const maxNonceLength = 64
+
 const (
 	typeSMS          = "sms"
 	typeIncomingCall = "incoming_call"
@@ -69,6 +76,7 @@ const (
 	userNotFound
 	apiRetired
 	rateLimited
+	unauthorized
 )
 
 type smsResponse struct {
@@ -76,40 +84,59 @@ type smsResponse struct {
 	Result *deliveryResult `json:"result"`
 }
 
-type deliverCommand struct {
-	sms    sms
-	result chan deliveryResult
+// keyDecryptor decrypts requests with one of the configured keysets
+type keyDecryptor struct {
+	primaryKeyID uint32
+	decryptor    tink.HybridDecrypt
 }
 
 type worker struct {
-	bot         *tg.BotAPI
-	db          *sql.DB
-	cfg         *config
-	client      *http.Client
-	deliverChan chan deliverCommand
-	decryptor   tink.HybridDecrypt
+	bot        *telegram.Bot
+	db         *database
+	cfgValue   atomic.Value // *config, swapped on reload
+	client     *http.Client
+	pool       *pool
+	decryptors []keyDecryptor
+
+	ipLimiter     *tokenBuckets
+	deviceLimiter *slidingWindows
+
+	args       []string // config arguments re-read on reload
+	instanceID string
+	leader     bool     // accessed by the main loop only
+	webhookSet bool     // whether the leader has set the webhook, accessed by the main loop only
+	broadcasts sync.Map // IDs of broadcasts running in this instance
 }
 
-func newWorker() *worker {
-	if len(os.Args) != 2 {
-		panic("usage: smsq <config>")
-	}
-	cfg := readConfig(os.Args[1])
+// cfg returns the current config, it is swapped as a whole on reload
+func (w *worker) cfg() *config { return w.cfgValue.Load().(*config) }
+
+func newWorker(args []string) *worker {
+	cfg := readConfig(args)
 	client := &http.Client{Timeout: time.Second * time.Duration(cfg.TimeoutSeconds)}
-	bot, err := tg.NewBotAPIWithClient(cfg.BotToken, tg.APIEndpoint, client)
-	checkErr(err)
-	db, err := sql.Open("sqlite3", cfg.DBPath)
-	checkErr(err)
-	decryptor, err := hybrid.NewHybridDecrypt(cfg.privateKey)
-	checkErr(err)
+	bot := telegram.New(cfg.BotToken, cfg.BotAPIEndpoint, client)
+	db := openDatabase(cfg)
+	var decryptors []keyDecryptor
+	for _, kh := range cfg.privateKeys {
+		decryptor, err := hybrid.NewHybridDecrypt(kh)
+		checkErr(err)
+		decryptors = append(decryptors, keyDecryptor{
+			primaryKeyID: kh.KeysetInfo().PrimaryKeyId,
+			decryptor:    decryptor,
+		})
+	}
 	w := &worker{
-		bot:         bot,
-		db:          db,
-		cfg:         cfg,
-		client:      client,
-		deliverChan: make(chan deliverCommand),
-		decryptor:   decryptor,
+		bot:        bot,
+		db:         db,
+		client:     client,
+		pool:       newPool(cfg.deliveryWorkers()),
+		decryptors: decryptors,
+		args:       args,
+		instanceID: newInstanceID(),
 	}
+	w.cfgValue.Store(cfg)
+	w.ipLimiter = newTokenBuckets(cfg.IPRateLimit, cfg.IPBurst)
+	w.deviceLimiter = newSlidingWindows(cfg.DeviceLimit, time.Duration(cfg.DeviceWindow)*time.Second)
 
 	return w
 }
@@ -130,6 +157,8 @@ func (r deliveryResult) String() string {
 		return "api_retired"
 	case rateLimited:
 		return "rate_limited"
+	case unauthorized:
+		return "unauthorized"
 	default:
 		return "undefined"
 	}
@@ -137,29 +166,28 @@ func (r deliveryResult) String() string {
 
 func (w *worker) logConfig() {
 	linf("smsq version: " + version)
-	cfgString, err := json.MarshalIndent(w.cfg, "", "    ")
+	cfgString, err := json.MarshalIndent(w.cfg().redacted(), "", "    ")
 	checkErr(err)
 	linf("config: " + string(cfgString))
 }
 
-func (w *worker) setWebhook() {
-	linf("setting webhook...")
-	_, err := w.bot.SetWebhook(tg.NewWebhook(path.Join(w.cfg.WebhookDomain, w.cfg.BotToken)))
-	checkErr(err)
+func (w *worker) logWebhookInfo() {
 	info, err := w.bot.GetWebhookInfo()
-	checkErr(err)
+	if err != nil {
+		lerr("cannot get webhook info, %v", err)
+		return
+	}
 	if info.LastErrorDate != 0 {
 		linf("last webhook error time: %v", time.Unix(int64(info.LastErrorDate), 0))
 	}
 	if info.LastErrorMessage != "" {
 		linf("last webhook error message: %s", info.LastErrorMessage)
 	}
-	linf("OK")
 }
 
 func (w *worker) removeWebhook() {
 	linf("removing webhook...")
-	_, err := w.bot.RemoveWebhook()
+	err := w.bot.DeleteWebhook()
 	checkErr(err)
 	linf("OK")
 }
@@ -173,26 +201,6 @@ func (w *worker) mustExec(query string, args ...interface{}) sql.Result {
 	return result
 }
 
-func (w *worker) storedMidnight() int64 {
-	if singleInt(w.db.QueryRow("select count(*) from midnight")) == 0 {
-		w.mustExec("insert into midnight (unix_time) values (0)")
-		return 0
-	}
-	return singleInt64(w.db.QueryRow("select unix_time from midnight"))
-}
-
-func (w *worker) storeMidnight(midnight int64) {
-	if singleInt(w.db.QueryRow("select count(*) from midnight")) == 0 {
-		w.mustExec("insert into midnight (unix_time) values (?)", midnight)
-		return
-	}
-	w.mustExec("update midnight set unix_time=?", midnight)
-}
-
-func midnight() int64 {
-	return time.Now().Truncate(24 * time.Hour).Unix()
-}
-
 func (w *worker) keyForChat(chatID int64) *string {
 	query, err := w.db.Query("select key from devices where chat_id=? and deleted=0 limit 1", chatID)
 	checkErr(err)
@@ -218,65 +226,101 @@ func (w *worker) chatForKey(chatKey string) (*int64, int) {
 	return &chatID, dailyLimit
 }
 
-func checkKey(key string) bool {
-	hash := sha256.Sum256([]byte(key))
-	hash = sha256.Sum256(hash[:])
-	return hash[0] == 0 && hash[1]&0xf0 == 0
+// checkKey checks the proof of work of a registered key,
+// version 1 keys of a lower difficulty can be restricted to devices registered before
+func (w *worker) checkKey(key string) bool {
+	if !pow.Check(key, w.cfg().keyDifficulty()) {
+		return false
+	}
+	if pow.Version(key) == 1 && w.cfg().RejectNewV1Keys {
+		return singleInt(w.db.QueryRow("select count(*) from devices where key=?", key)) != 0
+	}
+	return true
 }
 
 func (w *worker) userExists(chatID int64) bool {
 	return singleInt(w.db.QueryRow("select count(*) from devices where chat_id=? and deleted=0", chatID)) != 0
 }
 
-func (w *worker) deviceExists(key string) bool {
-	return singleInt(w.db.QueryRow("select count(*) from devices where key=? and deleted=0", key)) != 0
-}
-
 func (w *worker) deviceCount(chatID int64) int {
 	return singleInt(w.db.QueryRow("select count(*) from devices where chat_id=? and deleted=0", chatID))
 }
 
 func (w *worker) stop(chatID int64) {
+	// devices keep their secrets so that they are not connected by anyone knowing their keys
 	w.mustExec("update devices set deleted=1 where chat_id=?", chatID)
 	_ = w.sendText(chatID, false, parseRaw, "All devices disconnected")
 }
 
 func (w *worker) start(chatID int64, key string) {
+	// The user can only send /start after unblocking the bot
+	w.mustExec("delete from blocked_chats where chat_id=?", chatID)
 	if key == "" && w.userExists(chatID) {
 		count := w.deviceCount(chatID)
 		_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf("You have %d device(s) connected. Use /devices to manage.", count))
 		return
 	}
-	if key == "" || !checkKey(key) {
+	if key == "" || !w.checkKey(key) {
 		_ = w.sendText(chatID, false, parseRaw, "Install smsQ application on your phone https://smsq.me")
 		return
 	}
 
-	// Check if this exact device is already connected to this chat
-	if w.deviceExists(key) {
-		existingChatID, _ := w.chatForKey(key)
-		if existingChatID != nil && *existingChatID == chatID {
-			_ = w.sendText(chatID, false, parseRaw, "This device is already connected!")
-			return
-		}
-		// Device connected to another account - transfer it
-		if existingChatID != nil {
-			_ = w.sendText(*existingChatID, false, parseRaw, "One of your devices has been transferred to another Telegram account")
-		}
+	if w.keyBanned(key) {
+		_ = w.sendText(chatID, false, parseRaw, "This device is banned")
+		return
 	}
 
-	w.mustExec(`
-		insert or replace into devices (key, chat_id, daily_limit) values (?, ?, ?)`,
+	existingChatID, _ := w.chatForKey(key)
+	if existingChatID != nil && *existingChatID == chatID {
+		// connecting again lets the application claim the secret of a device registered before secrets
+		w.mustExec("update devices set claim_until=? where key=? and secret_claimed=0", time.Now().Add(claimWindow).Unix(), key)
+		_ = w.sendText(chatID, false, parseRaw, "This device is already connected!")
+		return
+	}
+
+	// the secret stays with the device, a device which has claimed it
+	// is moved or reconnected only after it allows it with a signed request
+	now := time.Now()
+	result := w.mustExec(`
+		insert into devices (key, chat_id, daily_limit, secret, claim_until) values (?, ?, ?, ?, ?)
+		on conflict(key) do update set
+			chat_id=excluded.chat_id,
+			name='',
+			delivered=0,
+			delivered_today=0,
+			received_today=0,
+			daily_limit=excluded.daily_limit,
+			deleted=0,
+			claim_until=case when devices.secret_claimed=0 then excluded.claim_until else 0 end,
+			rebind_until=0,
+			limit_notified=0,
+			last_seen=0
+		where devices.secret_claimed=0 or devices.rebind_until>=?`,
 		key,
 		chatID,
-		w.cfg.DeliveredLimit)
+		w.cfg().DeliveredLimit,
+		newSecret(),
+		now.Add(claimWindow).Unix(),
+		now.Unix())
+	rows, err := result.RowsAffected()
+	checkErr(err)
+	if rows != 1 {
+		_ = w.sendText(chatID, false, parseRaw, "This device is protected, connect it from the smsQ application on the device")
+		return
+	}
+	// device connected to another account is transferred
+	if existingChatID != nil {
+		_ = w.sendText(*existingChatID, false, parseRaw, "One of your devices has been transferred to another Telegram account")
+	}
 
 	count := w.deviceCount(chatID)
 	_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf("Device connected! You now have %d device(s). Use /devices to manage.", count))
 }
 
 func (w *worker) broadcastChats() (chats []int64) {
-	chatsQuery, err := w.db.Query(`select distinct chat_id from devices where deleted=0`)
+	chatsQuery, err := w.db.Query(`
+		select distinct chat_id from devices
+		where deleted=0 and chat_id not in (select chat_id from blocked_chats)`)
 	checkErr(err)
 	defer func() { checkErr(chatsQuery.Close()) }()
 	for chatsQuery.Next() {
@@ -287,26 +331,15 @@ func (w *worker) broadcastChats() (chats []int64) {
 	return
 }
 
-func (w *worker) broadcast(text string) {
-	if text == "" {
-		return
-	}
-	chats := w.broadcastChats()
-	for _, chatID := range chats {
-		_ = w.sendText(chatID, true, parseRaw, text)
-	}
-	_ = w.sendText(w.cfg.AdminID, false, parseRaw, "OK")
-}
-
-func (w *worker) direct(arguments string) {
+func (w *worker) direct(adminID int64, arguments string) {
 	parts := strings.SplitN(arguments, " ", 2)
 	if len(parts) < 2 {
-		_ = w.sendText(w.cfg.AdminID, false, parseRaw, "Usage: /direct chatID text")
+		_ = w.sendText(adminID, false, parseRaw, "Usage: /direct chatID text")
 		return
 	}
 	whom, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
-		_ = w.sendText(w.cfg.AdminID, false, parseRaw, "First argument is invalid")
+		_ = w.sendText(adminID, false, parseRaw, "First argument is invalid")
 		return
 	}
 	text := parts[1]
@@ -314,79 +347,129 @@ func (w *worker) direct(arguments string) {
 		return
 	}
 	_ = w.sendText(whom, true, parseRaw, text)
-	_ = w.sendText(w.cfg.AdminID, false, parseRaw, "OK")
+	_ = w.sendText(adminID, false, parseRaw, "OK")
 }
 
-func (w *worker) limit(arguments string) {
+func (w *worker) limit(adminID int64, arguments string) {
 	parts := strings.SplitN(arguments, " ", 2)
 	if len(parts) < 2 {
-		_ = w.sendText(w.cfg.AdminID, false, parseRaw, "Usage: /limit chatID text")
+		_ = w.sendText(adminID, false, parseRaw, "Usage: /limit chatID text")
 		return
 	}
 	whom, err := strconv.ParseInt(parts[0], 10, 64)
 	if err != nil {
-		_ = w.sendText(w.cfg.AdminID, false, parseRaw, "First argument is invalid")
+		_ = w.sendText(adminID, false, parseRaw, "First argument is invalid")
 		return
 	}
 	limit, err := strconv.ParseInt(parts[1], 10, 64)
 	if err != nil {
-		_ = w.sendText(w.cfg.AdminID, false, parseRaw, "Second argument is invalid")
+		_ = w.sendText(adminID, false, parseRaw, "Second argument is invalid")
 		return
 	}
-	result := w.mustExec("update devices set daily_limit=? where chat_id=?", limit, whom)
 	answer := "OK"
-	rows, err := result.RowsAffected()
-	checkErr(err)
-	if rows != 1 {
+	if !w.setLimit(whom, limit) {
 		answer = "User not found"
 	}
-	_ = w.sendText(w.cfg.AdminID, false, parseRaw, answer)
+	_ = w.sendText(adminID, false, parseRaw, answer)
+}
+
+// setLimit sets the daily limit of all devices of a chat
+func (w *worker) setLimit(chatID int64, limit int64) bool {
+	result := w.mustExec("update devices set daily_limit=? where chat_id=?", limit, chatID)
+	rows, err := result.RowsAffected()
+	checkErr(err)
+	return rows != 0
 }
 
 func (w *worker) processAdminMessage(chatID int64, command, arguments string) bool {
+	required, ok := commandRoles[command]
+	if !ok {
+		return false
+	}
+	role := w.adminRole(chatID)
+	if role == roleNone {
+		return false
+	}
+	if role < required {
+		_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf("This command requires the %v role", required))
+		return true
+	}
 	switch command {
 	case "stat":
-		w.stat()
-		return true
+		if arguments != "" {
+			w.statDays(chatID, arguments)
+		} else {
+			w.stat(chatID)
+		}
 	case "broadcast":
-		w.broadcast(arguments)
-		return true
+		w.broadcast(chatID, arguments)
+	case "broadcast_confirm":
+		w.broadcastConfirm(chatID)
+	case "broadcast_status":
+		w.broadcastStatus(chatID)
+	case "broadcast_cancel":
+		w.broadcastCancel(chatID)
 	case "direct":
-		w.direct(arguments)
-		return true
+		w.direct(chatID, arguments)
 	case "limit":
-		w.limit(arguments)
-		return true
+		w.limit(chatID, arguments)
+	case "user":
+		w.user(chatID, arguments)
+	case "ban":
+		w.ban(chatID, arguments, true)
+	case "unban":
+		w.ban(chatID, arguments, false)
+	case "devicekey":
+		w.deviceKey(chatID, arguments)
+	case "feedbacks":
+		w.feedbacks(chatID, arguments)
+	case "admin":
+		w.admin(chatID, arguments)
+	case "backup":
+		w.sendBackup(chatID)
 	}
-	return false
+	return true
 }
 
-func (w *worker) devices(chatID int64) {
-	query, err := w.db.Query("select key, name, delivered from devices where chat_id=? and deleted=0", chatID)
+type device struct {
+	key        string
+	name       string
+	delivered  int
+	dailyLimit int
+}
+
+func (w *worker) chatDevices(chatID int64) (devices []device) {
+	query, err := w.db.Query("select key, name, delivered, daily_limit from devices where chat_id=? and deleted=0", chatID)
 	checkErr(err)
 	defer func() { checkErr(query.Close()) }()
-
-	var lines []string
-	lines = append(lines, "<b>Your devices:</b>")
-	i := 0
 	for query.Next() {
-		var key, name string
-		var delivered int
-		checkErr(query.Scan(&key, &name, &delivered))
-		i++
-		displayName := name
-		if displayName == "" {
-			displayName = "Device " + strconv.Itoa(i)
-		}
-		shortKey := key[:8] + "..."
-		lines = append(lines, fmt.Sprintf("%d. %s (%s) - %d msgs", i, displayName, shortKey, delivered))
+		var d device
+		checkErr(query.Scan(&d.key, &d.name, &d.delivered, &d.dailyLimit))
+		devices = append(devices, d)
 	}
+	return
+}
 
-	if i == 0 {
+func (w *worker) devices(chatID int64) {
+	devices := w.chatDevices(chatID)
+	if len(devices) == 0 {
 		_ = w.sendText(chatID, false, parseRaw, "No devices connected. Use the app to connect.")
 		return
 	}
 
+	now := time.Now()
+	var lines []string
+	lines = append(lines, "<b>Your devices:</b>")
+	for i, d := range devices {
+		displayName := html.EscapeString(d.name)
+		if displayName == "" {
+			displayName = "Device " + strconv.Itoa(i+1)
+		}
+		shortKey := d.key[:8] + "..."
+		quota := w.quota(w.db, d.key, d.dailyLimit, now)
+		lines = append(lines, fmt.Sprintf("%d. %s (%s) - %d msgs, %v", i+1, displayName, shortKey, d.delivered, quota))
+	}
+
 	lines = append(lines, "")
 	lines = append(lines, "Use /stop to disconnect all devices")
 	_ = w.sendText(chatID, false, parseHTML, strings.Join(lines, "\n"))
@@ -394,7 +477,11 @@ func (w *worker) devices(chatID int64) {
 
 func (w *worker) processIncomingCommand(chatID int64, command, arguments string) {
 	command = strings.ToLower(command)
-	if chatID == w.cfg.AdminID && w.processAdminMessage(chatID, command, arguments) {
+	if w.processAdminMessage(chatID, command, arguments) {
+		return
+	}
+	if w.chatBanned(chatID) {
+		w.ldbg("ignoring banned chat %d", chatID)
 		return
 	}
 	switch command {
@@ -406,8 +493,12 @@ func (w *worker) processIncomingCommand(chatID int64, command, arguments string)
 		w.start(chatID, arguments)
 	case "devices":
 		w.devices(chatID)
+	case "usage":
+		w.usage(chatID, arguments)
+	case "topics":
+		w.topics(chatID, arguments)
 	case "challenge":
-		if reply, ok := w.cfg.Challenges[arguments]; ok {
+		if reply, ok := w.cfg().Challenges[arguments]; ok {
 			_ = w.sendText(chatID, false, parseRaw, reply)
 		} else {
 			_ = w.sendText(chatID, false, parseRaw, "Unknown command")
@@ -425,7 +516,9 @@ func (w *worker) processIncomingCommand(chatID int64, command, arguments string)
 				"Bot commands:\n"+
 				"<b>/help</b> — Help\n"+
 				"<b>/devices</b> — List connected devices\n"+
+				"<b>/usage</b> — Usage statistics\n"+
 				"<b>/stop</b> — Disconnect all devices\n"+
+				"<b>/topics</b> — Topics per device or per SIM in a forum supergroup\n"+
 				"<b>/feedback</b> — Send feedback")
 	default:
 		_ = w.sendText(chatID, false, parseRaw, "Unknown command")
@@ -433,8 +526,8 @@ func (w *worker) processIncomingCommand(chatID int64, command, arguments string)
 }
 
 func (w *worker) ourID() int64 {
-	if idx := strings.Index(w.cfg.BotToken, ":"); idx != -1 {
-		id, err := strconv.ParseInt(w.cfg.BotToken[:idx], 10, 64)
+	if idx := strings.Index(w.cfg().BotToken, ":"); idx != -1 {
+		id, err := strconv.ParseInt(w.cfg().BotToken[:idx], 10, 64)
 		checkErr(err)
 		return id
 	}
@@ -442,19 +535,19 @@ func (w *worker) ourID() int64 {
 	return 0
 }
 
-func (w *worker) processTGUpdate(u tg.Update) {
-	onlyInAPrivateChat := "smsq_bot works only in a private chat"
+func (w *worker) processTGUpdate(u telegram.Update) {
+	onlyInAPrivateChat := "smsq_bot works only in a private chat or in a forum supergroup you own"
 	if u.Message != nil && u.Message.Chat != nil {
-		if newMembers := u.Message.NewChatMembers; newMembers != nil && len(*newMembers) > 0 {
+		if newMembers := u.Message.NewChatMembers; len(newMembers) > 0 {
 			ourID := w.ourID()
-			for _, m := range *newMembers {
-				if int64(m.ID) == ourID {
+			for _, m := range newMembers {
+				if m.ID == ourID {
 					_ = w.sendText(u.Message.Chat.ID, false, parseRaw, onlyInAPrivateChat)
 					break
 				}
 			}
 		} else if u.Message.IsCommand() {
-			if u.Message.Chat.Type != "private" {
+			if u.Message.Chat.Type != "private" && !w.ownedForum(u.Message) {
 				_ = w.sendText(u.Message.Chat.ID, false, parseRaw, onlyInAPrivateChat)
 				return
 			}
@@ -471,67 +564,125 @@ func (w *worker) feedback(chatID int64, text string) {
 		_ = w.sendText(chatID, false, parseRaw, "Command format: /feedback <text>")
 		return
 	}
-	w.mustExec("insert into feedback (chat_id, text) values (?, ?)", chatID, text)
+	w.mustExec("insert into feedback (chat_id, text, created) values (?, ?, ?)", chatID, text, time.Now().Unix())
 	_ = w.sendText(chatID, false, parseRaw, "Thank you for your feedback")
-	_ = w.sendText(w.cfg.AdminID, true, parseRaw, fmt.Sprintf("Feedback from %d: %s", chatID, text))
+	_ = w.sendText(w.cfg().AdminID, true, parseRaw, fmt.Sprintf("Feedback from %d: %s", chatID, text))
 }
 
 func (w *worker) userCount() int {
-	query := w.db.QueryRow("select count(distinct chat_id) from devices where deleted=0")
+	query := w.db.QueryRow(`
+		select count(distinct chat_id) from devices
+		where deleted=0 and chat_id not in (select chat_id from blocked_chats)`)
 	return singleInt(query)
 }
 
 func (w *worker) deviceCountTotal() int {
-	query := w.db.QueryRow("select count(*) from devices where deleted=0")
+	query := w.db.QueryRow(`
+		select count(*) from devices
+		where deleted=0 and chat_id not in (select chat_id from blocked_chats)`)
 	return singleInt(query)
 }
 
 func (w *worker) activeUserCount() int {
-	query := w.db.QueryRow("select count(distinct chat_id) from devices where delivered > 0 and deleted=0")
+	query := w.db.QueryRow(`
+		select count(distinct chat_id) from devices
+		where delivered > 0 and deleted=0 and chat_id not in (select chat_id from blocked_chats)`)
+	return singleInt(query)
+}
+
+func (w *worker) blockedUserCount() int {
+	query := w.db.QueryRow("select count(*) from blocked_chats")
 	return singleInt(query)
 }
 
+func (w *worker) chatBlocked(chatID int64) bool {
+	return singleInt(w.db.QueryRow("select count(*) from blocked_chats where chat_id=?", chatID)) != 0
+}
+
+// markBlocked remembers that the user has blocked the bot
+func (w *worker) markBlocked(chatID int64) {
+	w.mustExec(`
+		insert into blocked_chats (chat_id, blocked_at) values (?, ?)
+		on conflict(chat_id) do update set blocked_at=excluded.blocked_at`,
+		chatID,
+		time.Now().Unix())
+}
+
 func (w *worker) smsCount() int {
 	query := w.db.QueryRow("select coalesce(sum(delivered), 0) from devices")
 	return singleInt(query)
 }
 
-func (w *worker) smsTodayCount() int {
-	query := w.db.QueryRow("select coalesce(sum(delivered_today), 0) from devices")
-	return singleInt(query)
+type keyUsage struct {
+	keyID    uint32
+	requests int
+}
+
+func (w *worker) keyUsage() (usage []keyUsage) {
+	query, err := w.db.Query("select key_id, requests from key_usage order by key_id")
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	for query.Next() {
+		var u keyUsage
+		checkErr(query.Scan(&u.keyID, &u.requests))
+		usage = append(usage, u)
+	}
+	return
 }
 
-func (w *worker) stat() {
+func (w *worker) stat(adminID int64) {
 	lines := []string{}
 	lines = append(lines, fmt.Sprintf("users: %d", w.userCount()))
 	lines = append(lines, fmt.Sprintf("devices: %d", w.deviceCountTotal()))
 	lines = append(lines, fmt.Sprintf("active users: %d", w.activeUserCount()))
+	lines = append(lines, fmt.Sprintf("blocked users: %d", w.blockedUserCount()))
 	lines = append(lines, fmt.Sprintf("smses: %d", w.smsCount()))
-	lines = append(lines, fmt.Sprintf("smses today: %d", w.smsTodayCount()))
-	_ = w.sendText(w.cfg.AdminID, false, parseRaw, strings.Join(lines, "\n"))
+	lines = append(lines, fmt.Sprintf("smses in 24h: %d", w.deliveredTotal(time.Now(), dayWindow)))
+	for _, u := range w.keyUsage() {
+		lines = append(lines, fmt.Sprintf("key %d: %d requests", u.keyID, u.requests))
+	}
+	_ = w.sendText(adminID, false, parseRaw, strings.Join(lines, "\n"))
+}
+
+// countKeyUsage counts requests decrypted with a key
+func (w *worker) countKeyUsage(keyID uint32) {
+	w.mustExec(`
+		insert into key_usage (key_id, requests) values (?, 1)
+		on conflict(key_id) do update set requests=key_usage.requests+1`,
+		keyID)
 }
 
 func (w *worker) sendText(chatID int64, notify bool, parse parseKind, text string) error {
-	msg := tg.NewMessage(chatID, text)
-	msg.DisableNotification = !notify
+	return w.sendThreadText(chatID, 0, notify, parse, text)
+}
+
+// sendThreadText sends a message to a forum topic, 0 means no topic
+func (w *worker) sendThreadText(chatID int64, threadID int, notify bool, parse parseKind, text string) error {
+	msg := telegram.SendMessageParams{
+		ChatID:              chatID,
+		MessageThreadID:     threadID,
+		Text:                text,
+		DisableNotification: !notify,
+	}
 	switch parse {
 	case parseHTML, parseMarkdown:
 		msg.ParseMode = parse.String()
 	}
-	return w.send(&messageConfig{msg})
+	return w.send(msg)
 }
 
-func (w *worker) send(msg baseChattable) error {
-	if _, err := w.bot.Send(msg); err != nil {
+func (w *worker) send(msg telegram.SendMessageParams) error {
+	if _, err := w.bot.SendMessage(msg); err != nil {
 		switch err := err.(type) {
-		case tg.Error:
+		case telegram.Error:
 			if err.Code == 403 {
-				linf("bot is blocked by the user %d, %v", msg.baseChat().ChatID, err)
+				linf("bot is blocked by the user %d, %v", msg.ChatID, err)
+				w.markBlocked(msg.ChatID)
 				return errBlockedByUser
 			}
-			lerr("cannot send a message to %d, code %d, %v", msg.baseChat().ChatID, err.Code, err)
+			lerr("cannot send a message to %d, code %d, %v", msg.ChatID, err.Code, err)
 		default:
-			lerr("unexpected error type while sending a message to %d, %v", msg.baseChat().ChatID, err)
+			lerr("unexpected error type while sending a message to %d, %v", msg.ChatID, err)
 		}
 		return err
 	}
@@ -550,33 +701,62 @@ func (w *worker) handleRetired(writer http.ResponseWriter, r *http.Request) {
 }
 
 func (w *worker) handleV1SMS(writer http.ResponseWriter, r *http.Request) {
+	w.handleSMS(writer, r, 1)
+}
+
+func (w *worker) handleV2SMS(writer http.ResponseWriter, r *http.Request) {
+	w.handleSMS(writer, r, 2)
+}
+
+// v2ContextInfo binds v2 ciphertexts to the API version and the device key
+func v2ContextInfo(key string) []byte {
+	return []byte("smsq/v2/" + key)
+}
+
+func (w *worker) handleSMS(writer http.ResponseWriter, r *http.Request, version int) {
 	if r.Method != "POST" {
 		http.Error(writer, "404 not found", http.StatusNotFound)
 		return
 	}
 
-	w.ldbg("got new SMS")
+	w.ldbg("got new SMS, API v%d", version)
+
+	if !w.allowIP(writer, r) {
+		return
+	}
 
 	var request smsRequest
 	err := json.NewDecoder(r.Body).Decode(&request)
 	if err != nil {
-		w.ldbg("cannot decode v1 request")
+		w.ldbg("cannot decode v%d request", version)
 		http.Error(writer, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if request.Version != 1 {
-		lerr("version is not 1")
-		http.Error(writer, err.Error(), http.StatusBadRequest)
+	if request.Version != version {
+		lerr("version is not %d", version)
+		http.Error(writer, "unexpected version", http.StatusBadRequest)
 		return
 	}
 
-	decrypted, err := w.decrypt(request.Payload)
+	var contextInfo []byte
+	if version == 2 {
+		if request.Key == "" {
+			w.ldbg("no key in v2 request")
+			http.Error(writer, "no key", http.StatusBadRequest)
+			return
+		}
+		contextInfo = v2ContextInfo(request.Key)
+	}
+
+	decrypted, keyID, err := w.decrypt(request.Payload, contextInfo)
 	if err != nil {
 		lerr("decryption error")
 		http.Error(writer, err.Error(), http.StatusBadRequest)
 		return
 	}
+	w.ldbg("decrypted with key %d", keyID)
+	w.countKeyUsage(keyID)
 
 	var sms sms
 	err = json.NewDecoder(bytes.NewReader(decrypted)).Decode(&sms)
@@ -597,16 +777,86 @@ func (w *worker) handleV1SMS(writer http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	deliver := deliverCommand{sms: sms, result: make(chan deliveryResult)}
-	defer close(deliver.result)
-	w.deliverChan <- deliver
-	result := <-deliver.result
-	w.apiReply(writer, result)
+	if !w.authorized(sms.Key, request) {
+		w.apiReply(writer, unauthorized)
+		lerr("invalid MAC")
+		return
+	}
+
+	if version == 2 {
+		if sms.Key != request.Key {
+			w.apiReply(writer, badRequest)
+			lerr("key mismatch")
+			return
+		}
+		if !w.fresh(sms.SentAt) {
+			w.apiReply(writer, badRequest)
+			w.ldbg("stale request")
+			return
+		}
+		if !w.storeNonce(sms.Key, sms.Nonce) {
+			w.apiReply(writer, badRequest)
+			lerr("replayed request")
+			return
+		}
+	}
+
+	// the device is limited only after the request is authenticated
+	// so that knowing a device key is not enough to exhaust its limit
+	if !w.allowDevice(writer, sms.Key) {
+		return
+	}
+
+	var chatID int64
+	if id, _ := w.chatForKey(sms.Key); id != nil {
+		chatID = *id
+	}
+	result := make(chan deliveryResult, 1)
+	w.pool.submit(chatID, func() { result <- w.deliver(sms) })
+	w.apiReply(writer, <-result)
+}
+
+// fresh checks that a client timestamp falls into the request window
+func (w *worker) fresh(sentAt int64) bool {
+	diff := time.Since(time.Unix(sentAt, 0))
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= w.cfg().requestWindow()
+}
+
+// storeNonce remembers a nonce until it leaves the request window,
+// it returns false if the nonce has already been used
+func (w *worker) storeNonce(key, nonce string) bool {
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return false
+	}
+	expires := time.Now().Add(2 * w.cfg().requestWindow()).Unix()
+	result := w.mustExec(`
+		insert into nonces (key, nonce, expires) values (?, ?, ?)
+		on conflict(key, nonce) do nothing`,
+		key,
+		nonce,
+		expires)
+	rows, err := result.RowsAffected()
+	checkErr(err)
+	return rows == 1
 }
 
+const blockedError = "the bot is blocked by the user, send /start to the bot to resume delivery"
+
 func (w *worker) apiReply(writer http.ResponseWriter, result deliveryResult) {
+	w.countResult(result)
+	writeReply(writer, result)
+}
+
+func writeReply(writer http.ResponseWriter, result deliveryResult) {
 	writer.WriteHeader(http.StatusOK)
 	res := smsResponse{Result: &result}
+	if result == blocked {
+		errorString := blockedError
+		res.Error = &errorString
+	}
 	resString, err := json.Marshal(res)
 	checkErr(err)
 	_, err = writer.Write(resString)
@@ -616,6 +866,9 @@ func (w *worker) apiReply(writer http.ResponseWriter, result deliveryResult) {
 func (w *worker) handleEndpoints() {
 	http.HandleFunc("/v0/sms", w.handleRetired)
 	http.HandleFunc("/v1/sms", w.handleV1SMS)
+	http.HandleFunc("/v2/sms", w.handleV2SMS)
+	http.HandleFunc("/v1/credentials", w.handleV1Credentials)
+	w.handleDashboardEndpoints()
 }
 
 func (w *worker) deliver(sms sms) deliveryResult {
@@ -625,17 +878,21 @@ func (w *worker) deliver(sms sms) deliveryResult {
 		return userNotFound
 	}
 
-	w.mustExec("update devices set received_today=received_today+1 where key=?", sms.Key)
-	receivedToday := singleInt(w.db.QueryRow("select received_today from devices where key=?", sms.Key))
-	if receivedToday >= w.cfg.ReceivedLimit+1 {
-		return rateLimited
+	now := time.Now()
+	w.mustExec("update devices set last_seen=? where key=?", now.Unix(), sms.Key)
+	if w.keyBanned(sms.Key) || w.chatBanned(*chatID) {
+		w.ldbg("banned device")
+		return unauthorized
+	}
+
+	if w.chatBlocked(*chatID) {
+		w.ldbg("the bot is blocked by the user %d", *chatID)
+		return blocked
 	}
 
-	deliveredToday := singleInt(w.db.QueryRow("select delivered_today from devices where key=?", sms.Key))
-	if deliveredToday >= dailyLimit {
-		if deliveredToday == dailyLimit {
-			w.mustExec("update devices set delivered_today=delivered_today+1 where key=?", sms.Key)
-			_ = w.sendText(*chatID, true, parseRaw, fmt.Sprintf("We cannot deliver more than %d messages a day", w.cfg.DeliveredLimit))
+	if limit, ok := w.admit(sms.Key, dailyLimit, now); !ok {
+		if limit != "" {
+			w.notifyLimit(*chatID, sms.Key, limit, now)
 		}
 		return rateLimited
 	}
@@ -670,7 +927,9 @@ func (w *worker) deliver(sms sms) deliveryResult {
 	}
 	text := strings.Join(lines, "\n")
 
-	if err := w.sendText(*chatID, true, parseHTML, text); err != nil {
+	if err := w.sendToTopic(*chatID, sms, text); err != nil {
+		uncount(w.db, sms.Key, now, counterDelivered)
+		count(w.db, sms.Key, now, counterFailed)
 		switch err {
 		case errBlockedByUser:
 			return blocked
@@ -678,67 +937,100 @@ func (w *worker) deliver(sms sms) deliveryResult {
 			return networkError
 		}
 	}
-	w.mustExec("update devices set delivered=delivered+1, delivered_today=delivered_today+1 where key=?", sms.Key)
+	w.mustExec("update devices set delivered=delivered+1 where key=?", sms.Key)
+	if sms.Type == typeIncomingCall {
+		count(w.db, sms.Key, now, counterCalls)
+	}
 	return delivered
 }
 
-func (w *worker) decrypt(str string) ([]byte, error) {
+// ciphertextKeyID returns the key ID from the Tink output prefix of a ciphertext
+func ciphertextKeyID(data []byte) (uint32, bool) {
+	if len(data) < 5 || data[0] != 1 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(data[1:5]), true
+}
+
+// decrypt tries every configured keyset and returns the ID of the key that worked
+func (w *worker) decrypt(str string, contextInfo []byte) ([]byte, uint32, error) {
 	data, err := base64.StdEncoding.DecodeString(str)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	result, err := w.decryptor.Decrypt(data, nil)
-	if err != nil {
-		return nil, err
+	for _, d := range w.decryptors {
+		result, err := d.decryptor.Decrypt(data, contextInfo)
+		if err != nil {
+			continue
+		}
+		keyID, ok := ciphertextKeyID(data)
+		if !ok {
+			keyID = d.primaryKeyID
+		}
+		return result, keyID, nil
 	}
-	return result, nil
+	return nil, 0, errors.New("no key can decrypt the payload")
 }
 
 func (w *worker) periodic() {
-	if m := midnight(); m > w.storedMidnight() {
-		w.storeMidnight(m)
-		w.mustExec("update devices set delivered_today=0, received_today=0")
+	w.ipLimiter.cleanup(time.Now())
+	w.deviceLimiter.cleanup(time.Now())
+	if !w.leader {
+		return
 	}
+	w.rollUpStats(time.Now())
+	w.cleanupCounters(time.Now())
+	w.mustExec("delete from results where hour<=?", time.Now().Add(-dayWindow).Unix())
+	w.mustExec("delete from nonces where expires<?", time.Now().Unix())
+	w.mustExec("delete from leases where expires<?", time.Now().Add(-leaseDuration).Unix())
 }
 
-func main() {
-	w := newWorker()
+// serveCommand runs the bot and the API until a termination signal
+func serveCommand(args []string) {
+	w := newWorker(args)
 	w.logConfig()
-	w.setWebhook()
 	w.createDatabase()
+	w.elect()
 
-	incoming := w.bot.ListenForWebhook("/" + w.cfg.BotToken)
+	incoming := w.listenForWebhook()
 	w.handleEndpoints()
 
-	go func() {
-		checkErr(http.ListenAndServe(w.cfg.ListenAddress, nil))
-	}()
+	go w.serve()
 
-	_ = w.sendText(w.cfg.AdminID, false, parseRaw, "Bot started")
+	_ = w.sendText(w.cfg().AdminID, false, parseRaw, "Bot started")
 
 	signals := make(chan os.Signal, 16)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT)
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
 	var periodicTimer = time.NewTicker(time.Minute * 10)
+	var leaseTimer = time.NewTicker(leaseRenewal)
 	for {
 		select {
+		case <-leaseTimer.C:
+			w.elect()
 		case <-periodicTimer.C:
 			w.periodic()
-		case s := <-w.deliverChan:
-			s.result <- w.deliver(s.sms)
 		case m := <-incoming:
 			chatString := ""
+			var chatID int64
 			if m.Message != nil && m.Message.Chat != nil {
-				chatString = fmt.Sprintf("chat: %d", m.Message.Chat.ID)
+				chatID = m.Message.Chat.ID
+				chatString = fmt.Sprintf("chat: %d", chatID)
+			} else if m.ChannelPost != nil && m.ChannelPost.Chat != nil {
+				chatID = m.ChannelPost.Chat.ID
 			}
 			textString := ""
 			if m.Message != nil {
 				textString = fmt.Sprintf("text: %s", m.Message.Text)
 			}
 			linf(strings.Join([]string{"got TG update", chatString, textString}, ", "))
-			w.processTGUpdate(m)
+			w.pool.submit(chatID, func() { w.processTGUpdate(m) })
+		case <-reloads:
+			w.reloadConfig()
 		case s := <-signals:
 			linf("got signal %v", s)
-			w.removeWebhook()
+			w.shutdown()
 			return
 		}
 	}
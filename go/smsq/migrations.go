@@ -1,34 +1,61 @@
 package main
 
 import (
-	"database/sql"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
 )
 
-var migrations = []func(w *worker){
-	func(w *worker) {
-		w.mustExec(`
+// migration changes the schema with up statements and reverts the change with down statements
+type migration struct {
+	// name describes the migration, it is a part of the checksum as fill cannot be,
+	// so a changed fill needs a new name
+	name string
+	up   []string
+	down []string
+	// fill sets added columns from the config after up statements
+	fill func(q querier, cfg *config)
+}
+
+// serialKey in migrations is replaced with the auto incremented primary key of the dialect
+const serialKey = "serial primary key"
+
+var migrations = []migration{
+	{
+		name: "feedback and users",
+		up: []string{`
 			create table if not exists feedback (
 				chat_id integer,
-				text text);`)
-		w.mustExec(`
+				text text)`, `
 			create table if not exists users (
 				chat_id integer primary key,
 				key text not null default '',
 				delivered integer not null default 0,
 				delivered_today integer not null default 0,
 				received_today integer not null default 0,
-				deleted integer not null default 0);`)
-		w.mustExec(`
+				deleted integer not null default 0)`, `
 			create table if not exists midnight (
-				unix_time integer not null default 0);`)
+				unix_time integer not null default 0)`,
+		},
+		down: []string{
+			"drop table midnight",
+			"drop table users",
+			"drop table feedback",
+		},
 	},
-	func(w *worker) {
-		w.mustExec("alter table users add daily_limit integer not null default 0;")
-		w.mustExec("update users set daily_limit=?", w.cfg.DeliveredLimit)
+	{
+		name: "daily limits of users",
+		up:   []string{"alter table users add daily_limit integer not null default 0"},
+		down: []string{"alter table users drop column daily_limit"},
+		fill: func(q querier, cfg *config) {
+			mustExecIn(q, "update users set daily_limit=?", cfg.DeliveredLimit)
+		},
 	},
-	// Migration: support multiple devices per Telegram account
-	func(w *worker) {
-		w.mustExec(`
+	{
+		name: "support multiple devices per Telegram account",
+		up: []string{`
 			create table if not exists devices (
 				key text primary key,
 				chat_id integer not null,
@@ -37,34 +64,419 @@ var migrations = []func(w *worker){
 				delivered_today integer not null default 0,
 				received_today integer not null default 0,
 				daily_limit integer not null default 0,
-				deleted integer not null default 0);`)
-		w.mustExec(`
+				deleted integer not null default 0)`, `
 			insert into devices (key, chat_id, name, delivered, delivered_today, received_today, daily_limit, deleted)
 			select key, chat_id, '', delivered, delivered_today, received_today, daily_limit, deleted
-			from users where key != '';`)
+			from users where key != ''`,
+		},
+		down: []string{"drop table devices"},
+	},
+	{
+		name: "count requests per decryption key",
+		up: []string{`
+			create table if not exists key_usage (
+				key_id integer primary key,
+				requests integer not null default 0)`,
+		},
+		down: []string{"drop table key_usage"},
+	},
+	{
+		name: "remember v2 nonces to reject replayed requests",
+		up: []string{`
+			create table if not exists nonces (
+				key text not null,
+				nonce text not null,
+				expires integer not null,
+				primary key (key, nonce))`,
+		},
+		down: []string{"drop table nonces"},
+	},
+	{
+		name: "per-device secrets issued on registration",
+		up: []string{
+			"alter table devices add secret text not null default ''",
+			"alter table devices add secret_claimed integer not null default 0",
+		},
+		down: []string{
+			"alter table devices drop column secret_claimed",
+			"alter table devices drop column secret",
+		},
+	},
+	{
+		name: "rolling window counters replacing midnight resets",
+		up: []string{`
+			create table if not exists counters (
+				key text not null,
+				bucket integer not null,
+				received integer not null default 0,
+				delivered integer not null default 0,
+				primary key (key, bucket))`,
+			"alter table devices add limit_notified integer not null default 0",
+		},
+		down: []string{
+			"alter table devices drop column limit_notified",
+			"drop table counters",
+		},
+	},
+	{
+		name: "bans, device activity and feedback time for admin commands",
+		up: []string{`
+			create table if not exists banned_chats (
+				chat_id integer primary key,
+				banned_at integer not null)`, `
+			create table if not exists banned_keys (
+				key text primary key,
+				banned_at integer not null)`,
+			"alter table devices add last_seen integer not null default 0",
+			"alter table feedback add created integer not null default 0",
+		},
+		down: []string{
+			"alter table feedback drop column created",
+			"alter table devices drop column last_seen",
+			"drop table banned_keys",
+			"drop table banned_chats",
+		},
 	},
+	{
+		name: "admins managed with the admin command",
+		up: []string{`
+			create table if not exists admins (
+				chat_id integer primary key,
+				role text not null)`,
+		},
+		down: []string{"drop table admins"},
+	},
+	{
+		name: "background broadcasts",
+		up: []string{`
+			create table if not exists broadcasts (
+				id ` + serialKey + `,
+				admin_id integer not null,
+				text text not null,
+				status text not null,
+				total integer not null default 0,
+				sent integer not null default 0,
+				failed integer not null default 0,
+				blocked integer not null default 0,
+				created integer not null)`, `
+			create table if not exists broadcast_queue (
+				broadcast_id integer not null,
+				chat_id integer not null,
+				primary key (broadcast_id, chat_id))`, `
+			create table if not exists blocked_chats (
+				chat_id integer primary key,
+				blocked_at integer not null)`,
+		},
+		down: []string{
+			"drop table blocked_chats",
+			"drop table broadcast_queue",
+			"drop table broadcasts",
+		},
+	},
+	{
+		name: "API results per hour for the dashboard",
+		up: []string{`
+			create table if not exists results (
+				hour integer not null,
+				result text not null,
+				count integer not null default 0,
+				primary key (hour, result))`,
+		},
+		down: []string{"drop table results"},
+	},
+	{
+		name: "daily statistics",
+		up: []string{
+			"alter table counters add rate_limited integer not null default 0",
+			"alter table counters add failed integer not null default 0",
+			"alter table counters add calls integer not null default 0", `
+			create table if not exists daily_stats (
+				day integer not null,
+				key text not null,
+				received integer not null default 0,
+				delivered integer not null default 0,
+				rate_limited integer not null default 0,
+				failed integer not null default 0,
+				calls integer not null default 0,
+				primary key (day, key))`,
+		},
+		down: []string{
+			"drop table daily_stats",
+			"alter table counters drop column calls",
+			"alter table counters drop column failed",
+			"alter table counters drop column rate_limited",
+		},
+	},
+	{
+		name: "webhook path and secret token in settings",
+		up: []string{`
+			create table settings (
+				name text primary key,
+				value text not null)`,
+		},
+		down: []string{"drop table settings"},
+	},
+	{
+		name: "forum supergroups and their topics per device or SIM",
+		up: []string{`
+			create table forum_chats (
+				chat_id integer primary key,
+				per_sim integer not null default 0)`, `
+			create table topics (
+				chat_id integer not null,
+				key text not null,
+				sim text not null,
+				thread_id integer not null,
+				primary key (chat_id, key, sim))`,
+		},
+		down: []string{
+			"drop table topics",
+			"drop table forum_chats",
+		},
+	},
+	{
+		name: "leases electing the leader among instances",
+		up: []string{`
+			create table leases (
+				name text primary key,
+				owner text not null,
+				expires integer not null)`,
+		},
+		down: []string{"drop table leases"},
+	},
+	{
+		// reverting it restores an empty table as devices cannot be merged back per chat
+		name: "drop legacy users replaced with devices",
+		up:   []string{"drop table users"},
+		down: []string{`
+			create table users (
+				chat_id integer primary key,
+				key text not null default '',
+				delivered integer not null default 0,
+				delivered_today integer not null default 0,
+				received_today integer not null default 0,
+				deleted integer not null default 0,
+				daily_limit integer not null default 0)`,
+		},
+	},
+	{
+		// devices which have claimed an empty secret claim the new one
+		name: "secrets for devices registered before per-device secrets",
+		fill: func(q querier, cfg *config) {
+			query, err := q.Query("select key from devices where secret=''")
+			checkErr(err)
+			var keys []string
+			for query.Next() {
+				var key string
+				checkErr(query.Scan(&key))
+				keys = append(keys, key)
+			}
+			checkErr(query.Close())
+			for _, key := range keys {
+				mustExecIn(q, "update devices set secret=?, secret_claimed=0 where key=?", newSecret(), key)
+			}
+		},
+	},
+	{
+		name: "windows for claiming secrets and moving devices which have claimed them",
+		up: []string{
+			"alter table devices add claim_until integer not null default 0",
+			"alter table devices add rebind_until integer not null default 0",
+		},
+		down: []string{
+			"alter table devices drop column rebind_until",
+			"alter table devices drop column claim_until",
+		},
+	},
+}
+
+// latestVersion is the schema version after all migrations
+func latestVersion() int { return len(migrations) - 1 }
+
+// checksum identifies migration n by its name, whether it has a fill and its up statements ignoring formatting
+func (m migration) checksum(n int) string {
+	hash := sha256.New()
+	_, _ = fmt.Fprintf(hash, "%d %q fill=%v\n", n, m.name, m.fill != nil)
+	for _, s := range m.up {
+		_, _ = hash.Write([]byte(strings.Join(strings.Fields(s), " ") + ";\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (d dialect) migrationStatement(s string) string {
+	return strings.Replace(s, serialKey, d.serialPrimaryKey(), 1)
 }
 
-func (w *worker) applyMigrations() {
-	row := w.db.QueryRow("select version from schema_version")
+// schemaVersion returns the number of the last applied migration, -1 if none
+func schemaVersion(q querier) int {
 	var version int
-	err := row.Scan(&version)
-	if err == sql.ErrNoRows {
-		version = -1
-		w.mustExec("insert into schema_version(version) values (0)")
+	checkErr(q.QueryRow("select version from schema_version").Scan(&version))
+	return version
+}
+
+// migrate applies migration n or reverts it in a transaction,
+// it returns false if another instance has already done it
+func (w *worker) migrate(n int, up bool) bool {
+	m := migrations[n]
+	tx, err := w.db.Begin()
+	checkErr(err)
+	// a failed statement rolls back the statements before it
+	defer func() { _ = tx.Rollback() }()
+	version := singleInt(tx.QueryRow("select version from schema_version" + tx.dialect.forUpdate()))
+	expected, statements := n-1, m.up
+	if !up {
+		expected, statements = n, m.down
+	}
+	if version != expected {
+		return false
+	}
+	for _, s := range statements {
+		mustExecIn(tx, tx.dialect.migrationStatement(s))
+	}
+	if up {
+		if m.fill != nil {
+			m.fill(tx, w.cfg())
+		}
+		mustExecIn(tx, "delete from schema_checksums where version=?", n)
+		mustExecIn(tx, "insert into schema_checksums (version, checksum) values (?, ?)", n, m.checksum(n))
+		mustExecIn(tx, "update schema_version set version=?", n)
 	} else {
-		checkErr(err)
+		mustExecIn(tx, "delete from schema_checksums where version=?", n)
+		mustExecIn(tx, "update schema_version set version=?", n-1)
 	}
-	for i, m := range migrations[version+1:] {
-		n := i + version + 1
+	checkErr(tx.Commit())
+	return true
+}
+
+// migrateUp applies pending migrations one by one
+func (w *worker) migrateUp() {
+	for n := schemaVersion(w.db) + 1; n <= latestVersion(); n++ {
 		linf("applying migration %d", n)
-		m(w)
-		w.mustExec("update schema_version set version=?", n)
+		if !w.migrate(n, true) {
+			linf("migration %d is applied by another instance", n)
+		}
+	}
+}
+
+// migrateDown reverts the last applied migration
+func (w *worker) migrateDown() {
+	n := schemaVersion(w.db)
+	if n < 0 {
+		linf("no migrations to revert")
+		return
+	}
+	linf("reverting migration %d", n)
+	if !w.migrate(n, false) {
+		panic(fmt.Sprintf("migration %d is reverted by another instance", n))
+	}
+}
+
+// checksumMismatch describes an applied migration changed since it was applied
+type checksumMismatch struct {
+	version  int
+	applied  string
+	expected string
+}
+
+// verifyChecksums checks the applied migrations against their current statements,
+// checksums of migrations applied before checksums were introduced are recorded as is
+func (w *worker) verifyChecksums() (mismatches []checksumMismatch) {
+	version := schemaVersion(w.db)
+	applied := map[int]string{}
+	query, err := w.db.Query("select version, checksum from schema_checksums")
+	checkErr(err)
+	for query.Next() {
+		var n int
+		var checksum string
+		checkErr(query.Scan(&n, &checksum))
+		applied[n] = checksum
+	}
+	checkErr(query.Err())
+	for n := 0; n <= version && n <= latestVersion(); n++ {
+		expected := migrations[n].checksum(n)
+		checksum, ok := applied[n]
+		switch {
+		case !ok:
+			w.mustExec("insert into schema_checksums (version, checksum) values (?, ?) on conflict(version) do nothing", n, expected)
+		case checksum != expected:
+			mismatches = append(mismatches, checksumMismatch{version: n, applied: checksum, expected: expected})
+		}
+	}
+	return
+}
+
+// initSchema creates the tables tracking migrations
+func (w *worker) initSchema() {
+	w.mustExec("create table if not exists schema_version (version integer)")
+	w.mustExec(`
+		create table if not exists schema_checksums (
+			version integer primary key,
+			checksum text not null)`)
+	w.mustExec("insert into schema_version (version) select -1 where not exists (select 1 from schema_version)")
+}
+
+// checkSchema refuses databases this build cannot serve
+func (w *worker) checkSchema() {
+	if version := schemaVersion(w.db); version > latestVersion() {
+		panic(fmt.Sprintf("schema version %d is newer than %d supported by this build", version, latestVersion()))
+	}
+	for _, m := range w.verifyChecksums() {
+		panic(fmt.Sprintf("migration %d has changed since it was applied, checksum %s, expected %s", m.version, m.applied, m.expected))
 	}
 }
 
 func (w *worker) createDatabase() {
 	linf("creating database if needed...")
-	w.mustExec(`create table if not exists schema_version (version integer);`)
-	w.applyMigrations()
+	w.initSchema()
+	w.checkSchema()
+	w.migrateUp()
+}
+
+// migrateCommand shows or changes the schema version
+func migrateCommand(args []string) {
+	if len(args) < 1 {
+		panic("usage: smsq migrate status|up|down [flags] [config]")
+	}
+	w := newWorker(args[1:])
+	w.initSchema()
+	switch args[0] {
+	case "status":
+		w.migrationStatus()
+	case "up":
+		w.checkSchema()
+		w.migrateUp()
+		linf("schema version is %d", schemaVersion(w.db))
+	case "down":
+		if running := runningInstances(w.db, time.Now()); running != 0 {
+			panic(fmt.Sprintf("%d instance(s) are running, stop them first", running))
+		}
+		w.checkSchema()
+		w.migrateDown()
+		linf("schema version is %d", schemaVersion(w.db))
+	default:
+		panic("unknown migrate command " + args[0])
+	}
+}
+
+// migrationStatus prints applied and pending migrations
+func (w *worker) migrationStatus() {
+	version := schemaVersion(w.db)
+	changed := map[int]bool{}
+	for _, m := range w.verifyChecksums() {
+		changed[m.version] = true
+	}
+	fmt.Printf("schema version %d of %d\n", version, latestVersion())
+	for n, m := range migrations {
+		status := "pending"
+		switch {
+		case changed[n]:
+			status = "changed"
+		case n <= version:
+			status = "applied"
+		}
+		fmt.Printf("%3d %-8s %s %s\n", n, status, m.checksum(n)[:12], m.name)
+	}
+	if version > latestVersion() {
+		fmt.Printf("the database is newer than this build\n")
+	}
 }
@@ -0,0 +1,111 @@
+package main
+
+import "testing"
+
+func TestMigrateHistoricalSchemas(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		for version := -1; version <= latestVersion(); version++ {
+			w := testWorker(t, d, "test")
+			w.initSchema()
+			for n := 0; n <= version; n++ {
+				if !w.migrate(n, true) {
+					t.Fatalf("migration %d is not applied", n)
+				}
+			}
+			w.migrateUp()
+			if v := schemaVersion(w.db); v != latestVersion() {
+				t.Errorf("from version %d: schema version = %d, want %d", version, v, latestVersion())
+			}
+			if m := w.verifyChecksums(); len(m) != 0 {
+				t.Errorf("from version %d: checksum mismatches %v", version, m)
+			}
+		}
+	})
+}
+
+func TestMigrateChecksumsOfOldBuilds(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		w := testWorker(t, d, "test")
+		w.createDatabase()
+		// builds before checksums did not record them
+		w.mustExec("delete from schema_checksums")
+		if m := w.verifyChecksums(); len(m) != 0 {
+			t.Errorf("checksum mismatches %v", m)
+		}
+		if n := singleInt(w.db.QueryRow("select count(*) from schema_checksums")); n != latestVersion()+1 {
+			t.Errorf("recorded checksums = %d, want %d", n, latestVersion()+1)
+		}
+		w.mustExec("update schema_checksums set checksum='changed' where version=3")
+		if m := w.verifyChecksums(); len(m) != 1 || m[0].version != 3 {
+			t.Errorf("checksum mismatches %v, want migration 3", m)
+		}
+	})
+}
+
+func TestMigrateDownUp(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, d dialect) {
+		w := testWorker(t, d, "test")
+		w.createDatabase()
+		for schemaVersion(w.db) >= 0 {
+			w.migrateDown()
+		}
+		if n := singleInt(w.db.QueryRow("select count(*) from schema_checksums")); n != 0 {
+			t.Errorf("checksums left = %d", n)
+		}
+		w.createDatabase()
+		if v := schemaVersion(w.db); v != latestVersion() {
+			t.Errorf("schema version = %d, want %d", v, latestVersion())
+		}
+		w.mustExec("insert into devices (key, chat_id) values ('key', 1)")
+	})
+}
+
+func TestMigrateRollsBack(t *testing.T) {
+	w := testWorker(t, sqlite, "test")
+	w.initSchema()
+	up := migrations[0].up
+	migrations[0].up = append(append([]string{}, up...), "not a statement")
+	defer func() { migrations[0].up = up }()
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("failed migration did not panic")
+			}
+		}()
+		w.migrate(0, true)
+	}()
+	if v := schemaVersion(w.db); v != -1 {
+		t.Errorf("schema version = %d, want -1", v)
+	}
+	if n := singleInt(w.db.QueryRow("select count(*) from sqlite_master where name='feedback'")); n != 0 {
+		t.Error("failed migration left tables")
+	}
+}
+
+func TestMigrationChecksums(t *testing.T) {
+	names := map[string]bool{}
+	checksums := map[string]bool{}
+	for n, m := range migrations {
+		if m.name == "" || names[m.name] {
+			t.Errorf("migration %d has an empty or repeated name %q", n, m.name)
+		}
+		names[m.name] = true
+		if checksums[m.checksum(n)] {
+			t.Errorf("migration %d has a repeated checksum", n)
+		}
+		checksums[m.checksum(n)] = true
+	}
+	for n, m := range migrations {
+		if m.fill == nil || len(m.up) != 0 {
+			continue
+		}
+		renamed := m
+		renamed.name += " changed"
+		if renamed.checksum(n) == m.checksum(n) {
+			t.Errorf("renaming fill-only migration %d does not change its checksum", n)
+		}
+		if m.checksum(n) == m.checksum(n+1) {
+			t.Errorf("moving fill-only migration %d does not change its checksum", n)
+		}
+	}
+}
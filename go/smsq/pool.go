@@ -0,0 +1,30 @@
+package main
+
+// pool runs tasks concurrently keeping tasks of the same chat in order
+// as tasks of a chat always go to the same worker goroutine
+type pool struct {
+	queues []chan func()
+}
+
+// queueSize is the number of tasks waiting for a worker goroutine before submitting blocks
+const queueSize = 100
+
+func newPool(workers int) *pool {
+	p := &pool{}
+	for i := 0; i < workers; i++ {
+		queue := make(chan func(), queueSize)
+		p.queues = append(p.queues, queue)
+		go func() {
+			for task := range queue {
+				task()
+			}
+		}()
+	}
+	return p
+}
+
+// submit queues a task of the chat
+func (p *pool) submit(chatID int64, task func()) {
+	n := uint64(chatID) % uint64(len(p.queues))
+	p.queues[n] <- task
+}
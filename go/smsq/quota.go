@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Counters are stored in time buckets so that limits apply to rolling windows
+const (
+	bucketSize = 5 * time.Minute
+	hourWindow = time.Hour
+	dayWindow  = 24 * time.Hour
+)
+
+func bucket(now time.Time) int64 {
+	return now.Truncate(bucketSize).Unix()
+}
+
+// Counter columns
+const (
+	counterReceived    = "received"
+	counterDelivered   = "delivered"
+	counterRateLimited = "rate_limited"
+	counterFailed      = "failed"
+	counterCalls       = "calls"
+)
+
+// count increments a counter of the current bucket
+func count(q querier, key string, now time.Time, counter string) {
+	mustExecIn(q, `
+		insert into counters (key, bucket, `+counter+`) values (?, ?, 1)
+		on conflict(key, bucket) do update set `+counter+`=counters.`+counter+`+1`,
+		key,
+		bucket(now))
+}
+
+// uncount reverts a counter incremented at the given time
+func uncount(q querier, key string, now time.Time, counter string) {
+	mustExecIn(q, "update counters set "+counter+"="+counter+"-1 where key=? and bucket=?", key, bucket(now))
+}
+
+// windowCounters returns received and delivered messages of a device in a rolling window
+func windowCounters(q querier, key string, now time.Time, window time.Duration) (received int, delivered int) {
+	row := q.QueryRow(`
+		select coalesce(sum(received), 0), coalesce(sum(delivered), 0)
+		from counters where key=? and bucket>?`,
+		key,
+		bucket(now.Add(-window)))
+	checkErr(row.Scan(&received, &delivered))
+	return
+}
+
+// deliveredTotal returns delivered messages of all devices in a rolling window
+func (w *worker) deliveredTotal(now time.Time, window time.Duration) int {
+	return singleInt(w.db.QueryRow("select coalesce(sum(delivered), 0) from counters where bucket>?", bucket(now.Add(-window))))
+}
+
+// quota describes the delivery limits of a device
+type quota struct {
+	dayLimit      int
+	dayDelivered  int
+	hourLimit     int
+	hourDelivered int
+}
+
+func (w *worker) quota(db querier, key string, dailyLimit int, now time.Time) quota {
+	q := quota{dayLimit: dailyLimit, hourLimit: w.cfg().DeliveredHourlyLimit}
+	_, q.dayDelivered = windowCounters(db, key, now, dayWindow)
+	if q.hourLimit != 0 {
+		_, q.hourDelivered = windowCounters(db, key, now, hourWindow)
+	}
+	return q
+}
+
+// exceeded returns the description of an exceeded limit if any
+func (q quota) exceeded() (string, bool) {
+	if q.dayDelivered >= q.dayLimit {
+		return fmt.Sprintf("We cannot deliver more than %d messages a day", q.dayLimit), true
+	}
+	if q.hourLimit != 0 && q.hourDelivered >= q.hourLimit {
+		return fmt.Sprintf("We cannot deliver more than %d messages an hour", q.hourLimit), true
+	}
+	return "", false
+}
+
+func remaining(limit, used int) int {
+	if used > limit {
+		return 0
+	}
+	return limit - used
+}
+
+func (q quota) String() string {
+	s := fmt.Sprintf("%d/%d left for 24h", remaining(q.dayLimit, q.dayDelivered), q.dayLimit)
+	if q.hourLimit != 0 {
+		s += fmt.Sprintf(", %d/%d for 1h", remaining(q.hourLimit, q.hourDelivered), q.hourLimit)
+	}
+	return s
+}
+
+// receivedExceeded checks received limits including the current message
+func (w *worker) receivedExceeded(q querier, key string, now time.Time) bool {
+	received, _ := windowCounters(q, key, now, dayWindow)
+	if received > w.cfg().ReceivedLimit {
+		return true
+	}
+	if w.cfg().ReceivedHourlyLimit != 0 {
+		received, _ = windowCounters(q, key, now, hourWindow)
+		if received > w.cfg().ReceivedHourlyLimit {
+			return true
+		}
+	}
+	return false
+}
+
+// admit counts a received message and reserves its delivery if limits allow it,
+// it returns the description of an exceeded delivery limit if any.
+// The device row is locked first so that instances sharing the database
+// check and update counters of a device one at a time.
+func (w *worker) admit(key string, dailyLimit int, now time.Time) (limit string, ok bool) {
+	tx, err := w.db.Begin()
+	checkErr(err)
+	// a panic must not leave the device locked for the other requests
+	defer func() { _ = tx.Rollback() }()
+	checkErr(tx.QueryRow("select key from devices where key=?"+tx.dialect.forUpdate(), key).Scan(&key))
+	count(tx, key, now, counterReceived)
+	limit, exceeded := w.quota(tx, key, dailyLimit, now).exceeded()
+	switch {
+	case w.receivedExceeded(tx, key, now):
+		limit = ""
+		count(tx, key, now, counterRateLimited)
+	case exceeded:
+		count(tx, key, now, counterRateLimited)
+	default:
+		count(tx, key, now, counterDelivered)
+		ok = true
+	}
+	checkErr(tx.Commit())
+	return limit, ok
+}
+
+// notifyLimit notifies a user about an exceeded limit once a day
+func (w *worker) notifyLimit(chatID int64, key string, text string, now time.Time) {
+	result := w.mustExec(
+		"update devices set limit_notified=? where key=? and limit_notified<=?",
+		now.Unix(),
+		key,
+		now.Add(-dayWindow).Unix())
+	rows, err := result.RowsAffected()
+	checkErr(err)
+	if rows == 1 {
+		_ = w.sendText(chatID, true, parseRaw, text)
+	}
+}
+
+// counterRetention keeps buckets of yesterday for the daily stats roll-up
+const counterRetention = 2 * dayWindow
+
+// cleanupCounters removes buckets which are not needed anymore
+func (w *worker) cleanupCounters(now time.Time) {
+	w.mustExec("delete from counters where bucket<=?", bucket(now.Add(-counterRetention)))
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenBuckets limits the request rate per client IP
+type tokenBuckets struct {
+	sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newTokenBuckets(perMinute int, burst int) *tokenBuckets {
+	b := &tokenBuckets{buckets: map[string]*tokenBucket{}}
+	b.configure(perMinute, burst)
+	return b
+}
+
+// configure changes the rate and the burst keeping the current buckets
+func (b *tokenBuckets) configure(perMinute int, burst int) {
+	b.Lock()
+	defer b.Unlock()
+	b.rate = float64(perMinute) / 60
+	b.burst = float64(burst)
+}
+
+// allow takes a token from the bucket, otherwise it returns the time to wait for the next token
+func (b *tokenBuckets) allow(id string, now time.Time) (bool, time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	bucket, ok := b.buckets[id]
+	if !ok {
+		bucket = &tokenBucket{tokens: b.burst, updated: now}
+		b.buckets[id] = bucket
+	}
+	bucket.tokens = math.Min(b.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*b.rate)
+	bucket.updated = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / b.rate * float64(time.Second))
+}
+
+// cleanup forgets full buckets
+func (b *tokenBuckets) cleanup(now time.Time) {
+	b.Lock()
+	defer b.Unlock()
+	for id, bucket := range b.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*b.rate >= b.burst {
+			delete(b.buckets, id)
+		}
+	}
+}
+
+// slidingWindows limits the number of requests per device key in a sliding window
+type slidingWindows struct {
+	sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[string][]time.Time
+}
+
+func newSlidingWindows(limit int, window time.Duration) *slidingWindows {
+	s := &slidingWindows{windows: map[string][]time.Time{}}
+	s.configure(limit, window)
+	return s
+}
+
+// configure changes the limit and the window keeping the recorded requests
+func (s *slidingWindows) configure(limit int, window time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.limit = limit
+	s.window = window
+}
+
+func (s *slidingWindows) trim(id string, now time.Time) []time.Time {
+	requests := s.windows[id]
+	i := 0
+	for i < len(requests) && now.Sub(requests[i]) >= s.window {
+		i++
+	}
+	requests = requests[i:]
+	if len(requests) == 0 {
+		delete(s.windows, id)
+		return nil
+	}
+	s.windows[id] = requests
+	return requests
+}
+
+// allow records a request, otherwise it returns the time to wait until the oldest request leaves the window
+func (s *slidingWindows) allow(id string, now time.Time) (bool, time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	requests := s.trim(id, now)
+	if len(requests) >= s.limit {
+		return false, s.window - now.Sub(requests[0])
+	}
+	s.windows[id] = append(requests, now)
+	return true, 0
+}
+
+// cleanup forgets requests outside of windows
+func (s *slidingWindows) cleanup(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for id := range s.windows {
+		s.trim(id, now)
+	}
+}
+
+// parseNetworks parses IP addresses and CIDR ranges
+func parseNetworks(addresses []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, a := range addresses {
+		if !strings.Contains(a, "/") {
+			if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+				a += "/32"
+			} else {
+				a += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(a)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (w *worker) trustedProxy(ip net.IP) bool {
+	for _, n := range w.cfg().trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the client address honoring X-Forwarded-For set by trusted proxies
+func (w *worker) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !w.trustedProxy(ip) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		ip := net.ParseIP(address)
+		if ip == nil {
+			break
+		}
+		host = address
+		if !w.trustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// rateLimitReply replies with rateLimited and the time to wait,
+// the reply is not counted so that limited requests cause no database writes
+func (w *worker) rateLimitReply(writer http.ResponseWriter, wait time.Duration) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeReply(writer, rateLimited)
+}
+
+// allowIP applies the per-IP limit, it replies if the request is limited
+func (w *worker) allowIP(writer http.ResponseWriter, r *http.Request) bool {
+	if w.cfg().IPRateLimit == 0 {
+		return true
+	}
+	ip := w.clientIP(r)
+	ok, wait := w.ipLimiter.allow(ip, time.Now())
+	if !ok {
+		w.ldbg("rate limited IP %s", ip)
+		w.rateLimitReply(writer, wait)
+	}
+	return ok
+}
+
+// allowDevice applies the per-device limit, it replies if the request is limited
+func (w *worker) allowDevice(writer http.ResponseWriter, key string) bool {
+	if w.cfg().DeviceLimit == 0 {
+		return true
+	}
+	ok, wait := w.deviceLimiter.allow(key, time.Now())
+	if !ok {
+		w.ldbg("rate limited device")
+		w.rateLimitReply(writer, wait)
+	}
+	return ok
+}
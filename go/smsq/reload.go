@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// reloadable lists config fields applied on SIGHUP, changing other fields requires a restart
+var reloadable = map[string]bool{
+	"debug":                  true,
+	"admins":                 true,
+	"challenges":             true,
+	"received_limit":         true,
+	"delivered_limit":        true,
+	"received_hourly_limit":  true,
+	"delivered_hourly_limit": true,
+	"request_window":         true,
+	"key_difficulty":         true,
+	"reject_new_v1_keys":     true,
+	"ip_rate_limit":          true,
+	"ip_burst":               true,
+	"device_limit":           true,
+	"device_window":          true,
+	"broadcast_rate":         true,
+}
+
+func jsonValue(v reflect.Value) string {
+	bytes, err := json.Marshal(v.Interface())
+	checkErr(err)
+	return string(bytes)
+}
+
+// reloadConfig re-reads the config and swaps it if only reloadable fields changed
+func (w *worker) reloadConfig() {
+	linf("reloading config")
+	loaded, err := loadConfig(w.args)
+	if err != nil {
+		lerr("config is not reloaded, %v", err)
+		return
+	}
+	current := w.cfg()
+	cfg := *current
+	currentFields, loadedFields, fields := current.fields(), loaded.fields(), cfg.fields()
+	var changes, refused []string
+	for i, f := range currentFields {
+		if reflect.DeepEqual(f.value.Interface(), loadedFields[i].value.Interface()) {
+			continue
+		}
+		if !reloadable[f.name] {
+			refused = append(refused, f.name)
+			continue
+		}
+		changes = append(changes, f.name+": "+jsonValue(f.value)+" -> "+jsonValue(loadedFields[i].value))
+		fields[i].value.Set(loadedFields[i].value)
+	}
+	if len(refused) != 0 {
+		lerr("config is not reloaded, restart to change %s", strings.Join(refused, ", "))
+		return
+	}
+	if len(changes) == 0 {
+		linf("config is not changed")
+		return
+	}
+	w.ipLimiter.configure(cfg.IPRateLimit, cfg.IPBurst)
+	w.deviceLimiter.configure(cfg.DeviceLimit, time.Duration(cfg.DeviceWindow)*time.Second)
+	w.cfgValue.Store(&cfg)
+	for _, c := range changes {
+		linf("config changed, %s", c)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type role int
+
+const (
+	roleNone role = iota
+	roleViewer
+	roleOperator
+	roleOwner
+)
+
+func (r role) String() string {
+	switch r {
+	case roleNone:
+		return "none"
+	case roleViewer:
+		return "viewer"
+	case roleOperator:
+		return "operator"
+	case roleOwner:
+		return "owner"
+	}
+	return "unknown"
+}
+
+func parseRole(s string) (role, error) {
+	switch s {
+	case "none":
+		return roleNone, nil
+	case "viewer":
+		return roleViewer, nil
+	case "operator":
+		return roleOperator, nil
+	case "owner":
+		return roleOwner, nil
+	}
+	return roleNone, fmt.Errorf("unknown role %q", s)
+}
+
+// MarshalJSON implements json.Marshaler
+func (r role) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(r.String())), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (r *role) UnmarshalJSON(data []byte) error {
+	s, err := strconv.Unquote(string(data))
+	if err != nil {
+		return errors.New("role should be a string")
+	}
+	*r, err = parseRole(s)
+	return err
+}
+
+// commandRoles are the roles required for admin commands
+var commandRoles = map[string]role{
+	"stat":              roleViewer,
+	"user":              roleViewer,
+	"devicekey":         roleViewer,
+	"feedbacks":         roleViewer,
+	"limit":             roleOperator,
+	"direct":            roleOperator,
+	"ban":               roleOperator,
+	"unban":             roleOperator,
+	"broadcast_status":  roleViewer,
+	"broadcast":         roleOwner,
+	"broadcast_confirm": roleOwner,
+	"broadcast_cancel":  roleOwner,
+	"admin":             roleOwner,
+	"backup":            roleOwner,
+}
+
+// adminRole returns the role of a chat,
+// admin_id is always the owner, the database overrides the config for other chats
+func (w *worker) adminRole(chatID int64) role {
+	if chatID == w.cfg().AdminID {
+		return roleOwner
+	}
+	query, err := w.db.Query("select role from admins where chat_id=?", chatID)
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	if query.Next() {
+		var name string
+		checkErr(query.Scan(&name))
+		r, err := parseRole(name)
+		checkErr(err)
+		return r
+	}
+	for _, a := range w.cfg().Admins {
+		if a.ID == chatID {
+			return a.Role
+		}
+	}
+	return roleNone
+}
+
+// admins returns effective roles of all admins
+func (w *worker) admins() map[int64]role {
+	admins := map[int64]role{}
+	for _, a := range w.cfg().Admins {
+		admins[a.ID] = a.Role
+	}
+	query, err := w.db.Query("select chat_id, role from admins")
+	checkErr(err)
+	defer func() { checkErr(query.Close()) }()
+	for query.Next() {
+		var chatID int64
+		var name string
+		checkErr(query.Scan(&chatID, &name))
+		r, err := parseRole(name)
+		checkErr(err)
+		admins[chatID] = r
+	}
+	admins[w.cfg().AdminID] = roleOwner
+	return admins
+}
+
+// admin manages admins stored in the database
+func (w *worker) admin(adminID int64, arguments string) {
+	usage := "Usage: /admin list | add chatID viewer|operator|owner | del chatID"
+	parts := strings.Fields(arguments)
+	if len(parts) == 1 && parts[0] == "list" {
+		admins := w.admins()
+		var chatIDs []int64
+		for chatID, r := range admins {
+			if r != roleNone {
+				chatIDs = append(chatIDs, chatID)
+			}
+		}
+		sort.Slice(chatIDs, func(i, j int) bool { return chatIDs[i] < chatIDs[j] })
+		var lines []string
+		for _, chatID := range chatIDs {
+			lines = append(lines, fmt.Sprintf("%d: %v", chatID, admins[chatID]))
+		}
+		_ = w.sendText(adminID, false, parseRaw, strings.Join(lines, "\n"))
+		return
+	}
+	if len(parts) < 2 || parts[0] != "add" && parts[0] != "del" {
+		_ = w.sendText(adminID, false, parseRaw, usage)
+		return
+	}
+	chatID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		_ = w.sendText(adminID, false, parseRaw, "Chat ID is invalid")
+		return
+	}
+	if chatID == w.cfg().AdminID {
+		_ = w.sendText(adminID, false, parseRaw, "admin_id is always the owner")
+		return
+	}
+	r := roleNone
+	switch {
+	case parts[0] == "add" && len(parts) == 3:
+		if r, err = parseRole(parts[2]); err != nil || r == roleNone {
+			_ = w.sendText(adminID, false, parseRaw, usage)
+			return
+		}
+	case parts[0] == "del" && len(parts) == 2:
+	default:
+		_ = w.sendText(adminID, false, parseRaw, usage)
+		return
+	}
+	// A deleted admin is stored with the none role to override the config
+	w.mustExec(`
+		insert into admins (chat_id, role) values (?, ?)
+		on conflict(chat_id) do update set role=excluded.role`,
+		chatID,
+		r.String())
+	_ = w.sendText(adminID, false, parseRaw, "OK")
+}
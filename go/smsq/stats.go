@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// globalStatsKey is the key of the daily stats of all devices
+const globalStatsKey = ""
+
+const (
+	defaultStatDays = 7
+	maxStatDays     = 90
+	chartWidth      = 12
+)
+
+type dayStats struct {
+	day         int64
+	received    int
+	delivered   int
+	rateLimited int
+	failed      int
+	calls       int
+}
+
+func day(now time.Time) int64 {
+	return now.Truncate(dayWindow).Unix()
+}
+
+// rollUpDay recomputes the daily stats of a day from the counters
+func (w *worker) rollUpDay(start int64) {
+	end := start + int64(dayWindow/time.Second)
+	w.mustExec(`
+		insert into daily_stats (day, key, received, delivered, rate_limited, failed, calls)
+		select cast(? as bigint), key, sum(received), sum(delivered), sum(rate_limited), sum(failed), sum(calls)
+		from counters where bucket>=? and bucket<? group by key
+		on conflict(day, key) do update set
+			received=excluded.received,
+			delivered=excluded.delivered,
+			rate_limited=excluded.rate_limited,
+			failed=excluded.failed,
+			calls=excluded.calls`,
+		start,
+		start,
+		end)
+	w.mustExec(`
+		insert into daily_stats (day, key, received, delivered, rate_limited, failed, calls)
+		select cast(? as bigint), cast(? as text), coalesce(sum(received), 0), coalesce(sum(delivered), 0), coalesce(sum(rate_limited), 0),
+			coalesce(sum(failed), 0), coalesce(sum(calls), 0)
+		from counters where bucket>=? and bucket<?
+		on conflict(day, key) do update set
+			received=excluded.received,
+			delivered=excluded.delivered,
+			rate_limited=excluded.rate_limited,
+			failed=excluded.failed,
+			calls=excluded.calls`,
+		start,
+		globalStatsKey,
+		start,
+		end)
+}
+
+// rollUpStats updates the daily stats of today and yesterday,
+// yesterday is needed to account for the last buckets before midnight
+func (w *worker) rollUpStats(now time.Time) {
+	today := day(now)
+	w.rollUpDay(today - int64(dayWindow/time.Second))
+	w.rollUpDay(today)
+}
+
+// statsSince returns daily stats summed over keys selected by conditions on daily stats and on counters.
+// Days before yesterday are read from the daily stats rolled up by the leader,
+// yesterday and today are summed from the counters as the roll-up may lag behind.
+func (w *worker) statsSince(since int64, now time.Time, dailyCondition string, countersCondition string, args ...interface{}) (stats []dayStats) {
+	today := day(now)
+	yesterday := today - int64(dayWindow/time.Second)
+	query, err := w.db.Query(`
+		select day, sum(received), sum(delivered), sum(rate_limited), sum(failed), sum(calls)
+		from daily_stats where day>=? and day<? and `+dailyCondition+` group by day order by day`,
+		append([]interface{}{since, yesterday}, args...)...)
+	checkErr(err)
+	for query.Next() {
+		var s dayStats
+		checkErr(query.Scan(&s.day, &s.received, &s.delivered, &s.rateLimited, &s.failed, &s.calls))
+		stats = append(stats, s)
+	}
+	checkErr(query.Close())
+	for _, start := range []int64{yesterday, today} {
+		if start < since {
+			continue
+		}
+		if s, ok := w.countersStats(start, countersCondition, args...); ok {
+			stats = append(stats, s)
+		}
+	}
+	return
+}
+
+// countersStats sums the counters of a day without writing anything, it returns false if there are none
+func (w *worker) countersStats(start int64, condition string, args ...interface{}) (dayStats, bool) {
+	s := dayStats{day: start}
+	var buckets int
+	end := start + int64(dayWindow/time.Second)
+	checkErr(w.db.QueryRow(`
+		select count(*), coalesce(sum(received), 0), coalesce(sum(delivered), 0), coalesce(sum(rate_limited), 0),
+			coalesce(sum(failed), 0), coalesce(sum(calls), 0)
+		from counters where bucket>=? and bucket<? and `+condition,
+		append([]interface{}{start, end}, args...)...).Scan(&buckets, &s.received, &s.delivered, &s.rateLimited, &s.failed, &s.calls))
+	return s, buckets != 0
+}
+
+// chart renders daily stats as a compact text chart of delivered messages
+func chart(stats []dayStats) string {
+	max := 0
+	for _, s := range stats {
+		if s.delivered > max {
+			max = s.delivered
+		}
+	}
+	var lines []string
+	for _, s := range stats {
+		width := 0
+		if max != 0 {
+			width = (s.delivered*chartWidth + max - 1) / max
+		}
+		lines = append(lines, fmt.Sprintf("%s %-*s %d (%d sms, %d calls, %d limited, %d failed)",
+			time.Unix(s.day, 0).UTC().Format("01-02"),
+			chartWidth,
+			strings.Repeat("█", width),
+			s.delivered,
+			s.delivered-s.calls,
+			s.calls,
+			s.rateLimited,
+			s.failed))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func parseDays(arguments string) (int, bool) {
+	if arguments = strings.TrimSpace(arguments); arguments == "" {
+		return defaultStatDays, true
+	}
+	days, err := strconv.Atoi(arguments)
+	if err != nil || days <= 0 || days > maxStatDays {
+		return 0, false
+	}
+	return days, true
+}
+
+func since(days int) int64 {
+	return day(time.Now()) - int64(days-1)*int64(dayWindow/time.Second)
+}
+
+// statDays shows global daily stats to an admin
+func (w *worker) statDays(adminID int64, arguments string) {
+	days, ok := parseDays(arguments)
+	if !ok {
+		_ = w.sendText(adminID, false, parseRaw, fmt.Sprintf("Usage: /stat [days], at most %d days", maxStatDays))
+		return
+	}
+	// device keys are never empty so all counters are selected
+	stats := w.statsSince(since(days), time.Now(), "key=?", "key!=?", globalStatsKey)
+	if len(stats) == 0 {
+		_ = w.sendText(adminID, false, parseRaw, "No statistics")
+		return
+	}
+	_ = w.sendText(adminID, false, parseHTML, "<pre>"+chart(stats)+"</pre>")
+}
+
+// usage shows daily stats of all devices of a user
+func (w *worker) usage(chatID int64, arguments string) {
+	days, ok := parseDays(arguments)
+	if !ok {
+		_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf("Command format: /usage [days], at most %d days", maxStatDays))
+		return
+	}
+	devices := "key in (select key from devices where chat_id=? and deleted=0)"
+	stats := w.statsSince(since(days), time.Now(), devices, devices, chatID)
+	if len(stats) == 0 {
+		_ = w.sendText(chatID, false, parseRaw, "No messages delivered yet")
+		return
+	}
+	_ = w.sendText(chatID, false, parseHTML, "<pre>"+chart(stats)+"</pre>")
+}
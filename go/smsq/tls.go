@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// selfSigned checks if the first certificate in the file is self-signed
+func selfSigned(certFile string) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Clean(certFile))
+	if err != nil {
+		return false, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return false, errors.New("no PEM certificate found")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false, nil
+	}
+	// CheckSignatureFrom rejects self-signed leaf certificates lacking the CA basic constraint
+	return cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil, nil
+}
+
+// webhookCertificate returns the certificate file to upload to Telegram if it is self-signed
+func (w *worker) webhookCertificate() string {
+	if w.cfg().TLSCert == "" {
+		return ""
+	}
+	self, err := selfSigned(w.cfg().TLSCert)
+	checkErr(err)
+	if !self {
+		return ""
+	}
+	linf("uploading self-signed certificate")
+	return w.cfg().TLSCert
+}
+
+// acmeClient returns the ACME client for the configured directory trusting the configured CA
+func (w *worker) acmeClient() *acme.Client {
+	cfg := w.cfg()
+	if cfg.ACMEDirectory == "" {
+		return nil
+	}
+	client := &acme.Client{DirectoryURL: cfg.ACMEDirectory}
+	if cfg.ACMECA != "" {
+		bytes, err := ioutil.ReadFile(filepath.Clean(cfg.ACMECA))
+		checkErr(err)
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(bytes) {
+			panic("no CA certificates found in " + cfg.ACMECA)
+		}
+		client.HTTPClient = &http.Client{
+			Timeout:   w.client.Timeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}},
+		}
+	}
+	return client
+}
+
+func (w *worker) certManager() *autocert.Manager {
+	cfg := w.cfg()
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEHosts...),
+		Email:      cfg.ACMEEmail,
+		Client:     w.acmeClient(),
+	}
+	if cfg.ACMECacheDir != "" {
+		manager.Cache = autocert.DirCache(cfg.ACMECacheDir)
+	}
+	return manager
+}
+
+// serve listens to incoming requests terminating TLS if configured
+func (w *worker) serve() {
+	cfg := w.cfg()
+	server := &http.Server{Addr: cfg.ListenAddress}
+	switch {
+	case cfg.TLSCert != "":
+		linf("serving TLS with the certificate %s", cfg.TLSCert)
+		checkErr(server.ListenAndServeTLS(cfg.TLSCert, cfg.TLSKey))
+	case len(cfg.ACMEHosts) != 0:
+		linf("serving TLS with ACME certificates")
+		manager := w.certManager()
+		server.TLSConfig = manager.TLSConfig()
+		if cfg.ACMEHTTPAddress != "" {
+			go func() {
+				checkErr(http.ListenAndServe(cfg.ACMEHTTPAddress, manager.HTTPHandler(nil)))
+			}()
+		}
+		checkErr(server.ListenAndServeTLS("", ""))
+	default:
+		checkErr(server.ListenAndServe())
+	}
+}
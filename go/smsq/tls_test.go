@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate writes a certificate signed by the parent, a nil parent makes it self-signed
+func testCertificate(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (string, *x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkErr(err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		DNSNames:              []string{name},
+		BasicConstraintsValid: isCA,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	checkErr(err)
+	cert, err := x509.ParseCertificate(der)
+	checkErr(err)
+	file := filepath.Join(t.TempDir(), name+".pem")
+	checkErr(ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return file, cert, key
+}
+
+func TestSelfSigned(t *testing.T) {
+	caFile, ca, caKey := testCertificate(t, "ca", true, nil, nil)
+	leafFile, _, _ := testCertificate(t, "example.com", false, nil, nil)
+	issuedFile, _, _ := testCertificate(t, "issued.example.com", false, ca, caKey)
+	tests := []struct {
+		name string
+		file string
+		want bool
+	}{
+		{"self-signed CA", caFile, true},
+		{"self-signed leaf without the CA constraint", leafFile, true},
+		{"issued by a CA", issuedFile, false},
+	}
+	for _, tt := range tests {
+		got, err := selfSigned(tt.file)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: selfSigned = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
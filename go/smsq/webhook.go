@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/igrmk/smsq/go/smsq/telegram"
+)
+
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// updatesBuffer is the number of updates waiting for the main loop
+const updatesBuffer = 100
+
+func randomHex(n int) string {
+	bytes := make([]byte, n)
+	_, err := rand.Read(bytes)
+	checkErr(err)
+	return hex.EncodeToString(bytes)
+}
+
+// setting returns a stored setting generating and storing it if it is missing
+func (w *worker) setting(name string, generate func() string) string {
+	var value string
+	err := w.db.QueryRow("select value from settings where name=?", name).Scan(&value)
+	if err != sql.ErrNoRows {
+		checkErr(err)
+		return value
+	}
+	w.mustExec("insert into settings (name, value) values (?, ?) on conflict(name) do nothing", name, generate())
+	checkErr(w.db.QueryRow("select value from settings where name=?", name).Scan(&value))
+	return value
+}
+
+// webhookPath returns the random webhook path, it does not contain the bot token
+func (w *worker) webhookPath() string {
+	return "/" + w.setting("webhook_path", func() string { return randomHex(16) })
+}
+
+// webhookSecret returns the secret token Telegram sends with every update
+func (w *worker) webhookSecret() string {
+	return w.setting("webhook_secret", func() string { return randomHex(32) })
+}
+
+func (w *worker) setWebhook() error {
+	linf("setting webhook...")
+	link := path.Join(w.cfg().WebhookDomain, w.webhookPath())
+	info, err := w.bot.GetWebhookInfo()
+	if err != nil {
+		return err
+	}
+	if strings.Contains(info.URL, w.cfg().BotToken) {
+		linf("migrating webhook from the bot token path")
+	}
+	err = w.bot.SetWebhook(telegram.WebhookParams{
+		URL:         link,
+		SecretToken: w.webhookSecret(),
+		Certificate: w.webhookCertificate(),
+	})
+	if err != nil {
+		return err
+	}
+	w.logWebhookInfo()
+	linf("OK")
+	return nil
+}
+
+// listenForWebhook passes updates carrying the secret token to the channel
+func (w *worker) listenForWebhook() <-chan telegram.Update {
+	updates := make(chan telegram.Update, updatesBuffer)
+	secret := []byte(w.webhookSecret())
+	http.HandleFunc(w.webhookPath(), func(writer http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(secretTokenHeader)), secret) != 1 {
+			w.ldbg("webhook request without the secret token")
+			writer.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		bytes, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var update telegram.Update
+		if err := json.Unmarshal(bytes, &update); err != nil {
+			lerr("cannot decode update, %v", err)
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		updates <- update
+	})
+	return updates
+}
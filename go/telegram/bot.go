@@ -0,0 +1,188 @@
+// Package telegram is a thin client of the Telegram Bot API
+// implementing just the methods smsq needs.
+//
+// Requests are plain HTTP POST requests with JSON or multipart bodies,
+// the endpoint is configurable so a local Bot API server or a fake one can be used.
+package telegram
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// DefaultEndpoint is the official Bot API endpoint
+const DefaultEndpoint = "https://api.telegram.org"
+
+// Error is an error returned by the Bot API
+type Error struct {
+	Code        int
+	Description string
+	RetryAfter  int // seconds to wait before repeating the request if flood control is exceeded
+}
+
+func (e Error) Error() string { return fmt.Sprintf("telegram error %d: %s", e.Code, e.Description) }
+
+type response struct {
+	OK          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Parameters  *struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// Bot calls Bot API methods
+type Bot struct {
+	token    string
+	endpoint string
+	client   *http.Client
+}
+
+// New creates a bot, an empty endpoint means DefaultEndpoint
+func New(token string, endpoint string, client *http.Client) *Bot {
+	if endpoint == "" {
+		endpoint = DefaultEndpoint
+	}
+	return &Bot{token: token, endpoint: endpoint, client: client}
+}
+
+// Call calls a method with JSON encoded params and decodes the result into result if it is not nil
+func (b *Bot) Call(method string, params interface{}, result interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return b.post(method, "application/json", bytes.NewReader(body), result)
+}
+
+// upload calls a method uploading a file as a multipart form
+func (b *Bot) upload(method string, params map[string]string, field string, file string, result interface{}) error {
+	f, err := os.Open(filepath.Clean(file))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	for k, v := range params {
+		if err := form.WriteField(k, v); err != nil {
+			return err
+		}
+	}
+	part, err := form.CreateFormFile(field, filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return err
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+	return b.post(method, form.FormDataContentType(), body, result)
+}
+
+func (b *Bot) post(method string, contentType string, body io.Reader, result interface{}) error {
+	resp, err := b.client.Post(b.endpoint+"/bot"+b.token+"/"+method, contentType, body)
+	if err != nil {
+		// the URL contains the token, do not let it get into logs
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("%s: cannot decode response with status %d, %w", method, resp.StatusCode, err)
+	}
+	if !r.OK {
+		e := Error{Code: r.ErrorCode, Description: r.Description}
+		if r.Parameters != nil {
+			e.RetryAfter = r.Parameters.RetryAfter
+		}
+		return e
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, result)
+}
+
+// GetMe returns the bot user
+func (b *Bot) GetMe() (User, error) {
+	var user User
+	err := b.Call("getMe", struct{}{}, &user)
+	return user, err
+}
+
+// SendMessage sends a text message
+func (b *Bot) SendMessage(params SendMessageParams) (Message, error) {
+	var message Message
+	err := b.Call("sendMessage", params, &message)
+	return message, err
+}
+
+// SetWebhook sets the webhook uploading the certificate if it is given
+func (b *Bot) SetWebhook(params WebhookParams) error {
+	if params.Certificate == "" {
+		return b.Call("setWebhook", params, nil)
+	}
+	fields := map[string]string{"url": params.URL}
+	if params.SecretToken != "" {
+		fields["secret_token"] = params.SecretToken
+	}
+	return b.upload("setWebhook", fields, "certificate", params.Certificate, nil)
+}
+
+// DeleteWebhook removes the webhook
+func (b *Bot) DeleteWebhook() error {
+	return b.Call("deleteWebhook", struct{}{}, nil)
+}
+
+// GetWebhookInfo returns the webhook status
+func (b *Bot) GetWebhookInfo() (WebhookInfo, error) {
+	var info WebhookInfo
+	err := b.Call("getWebhookInfo", struct{}{}, &info)
+	return info, err
+}
+
+// GetChatMember returns the status of a chat member
+func (b *Bot) GetChatMember(chatID int64, userID int64) (ChatMember, error) {
+	var member ChatMember
+	err := b.Call("getChatMember", map[string]int64{"chat_id": chatID, "user_id": userID}, &member)
+	return member, err
+}
+
+// CreateForumTopic creates a topic in a forum supergroup
+func (b *Bot) CreateForumTopic(chatID int64, name string) (ForumTopic, error) {
+	var topic ForumTopic
+	params := struct {
+		ChatID int64  `json:"chat_id"`
+		Name   string `json:"name"`
+	}{chatID, name}
+	err := b.Call("createForumTopic", params, &topic)
+	return topic, err
+}
+
+// SendDocument uploads a file as a document
+func (b *Bot) SendDocument(chatID int64, file string, caption string) (Message, error) {
+	var message Message
+	params := map[string]string{"chat_id": strconv.FormatInt(chatID, 10)}
+	if caption != "" {
+		params["caption"] = caption
+	}
+	err := b.upload("sendDocument", params, "document", file, &message)
+	return message, err
+}
@@ -0,0 +1,197 @@
+package telegram
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testToken = "123:secret"
+
+// fakeRequest is a request received by the fake Bot API
+type fakeRequest struct {
+	method string
+	json   map[string]interface{}
+	fields map[string]string
+	files  map[string]string
+}
+
+// fakeAPI starts a fake Bot API replying with the reply of the called method
+func fakeAPI(t *testing.T, replies map[string]string) (*Bot, *[]fakeRequest) {
+	t.Helper()
+	var requests []fakeRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := "/bot" + testToken + "/"
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		req := fakeRequest{method: strings.TrimPrefix(r.URL.Path, prefix), fields: map[string]string{}, files: map[string]string{}}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Error(err)
+			}
+			for k, v := range r.MultipartForm.Value {
+				req.fields[k] = v[0]
+			}
+			for k, v := range r.MultipartForm.File {
+				f, err := v[0].Open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := ioutil.ReadAll(f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.files[k] = v[0].Filename + ":" + string(data)
+			}
+		} else if err := json.NewDecoder(r.Body).Decode(&req.json); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, req)
+		reply, ok := replies[req.method]
+		if !ok {
+			reply = `{"ok":true,"result":true}`
+		}
+		_, _ = w.Write([]byte(reply))
+	}))
+	t.Cleanup(server.Close)
+	return New(testToken, server.URL, server.Client()), &requests
+}
+
+func TestCallErrors(t *testing.T) {
+	bot, _ := fakeAPI(t, map[string]string{
+		"sendMessage":    `{"ok":false,"error_code":429,"description":"Too Many Requests: retry after 7","parameters":{"retry_after":7}}`,
+		"getMe":          `{"ok":false,"error_code":401,"description":"Unauthorized"}`,
+		"getWebhookInfo": `not json`,
+	})
+	tests := []struct {
+		name string
+		call func() error
+		want Error
+	}{
+		{"retry after", func() error { _, err := bot.SendMessage(SendMessageParams{ChatID: 1, Text: "text"}); return err }, Error{429, "Too Many Requests: retry after 7", 7}},
+		{"unauthorized", func() error { _, err := bot.GetMe(); return err }, Error{401, "Unauthorized", 0}},
+	}
+	for _, tt := range tests {
+		err := tt.call()
+		var got Error
+		if !errors.As(err, &got) || got != tt.want {
+			t.Errorf("%s: error = %#v, want %#v", tt.name, err, tt.want)
+		}
+	}
+	if _, err := bot.GetWebhookInfo(); err == nil || errors.As(err, new(Error)) {
+		t.Errorf("invalid response: error = %v", err)
+	}
+}
+
+func TestCallHidesToken(t *testing.T) {
+	bot := New(testToken, "http://127.0.0.1:1", http.DefaultClient)
+	_, err := bot.GetMe()
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	bot, requests := fakeAPI(t, map[string]string{
+		"sendMessage": `{"ok":true,"result":{"message_id":5,"chat":{"id":1,"type":"private"},"text":"text"}}`,
+	})
+	message, err := bot.SendMessage(SendMessageParams{ChatID: 1, MessageThreadID: 3, Text: "text", ParseMode: "HTML"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.MessageID != 5 || message.Chat.ID != 1 {
+		t.Errorf("message = %+v", message)
+	}
+	got := (*requests)[0].json
+	if got["chat_id"] != 1.0 || got["message_thread_id"] != 3.0 || got["parse_mode"] != "HTML" {
+		t.Errorf("params = %v", got)
+	}
+}
+
+func TestSetWebhook(t *testing.T) {
+	certificate := filepath.Join(t.TempDir(), "cert.pem")
+	if err := ioutil.WriteFile(certificate, []byte("certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bot, requests := fakeAPI(t, nil)
+	if err := bot.SetWebhook(WebhookParams{URL: "https://example.com/path", SecretToken: "token"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.SetWebhook(WebhookParams{URL: "https://example.com/path", SecretToken: "token", Certificate: certificate}); err != nil {
+		t.Fatal(err)
+	}
+	plain, multipart := (*requests)[0], (*requests)[1]
+	if plain.json["url"] != "https://example.com/path" || plain.json["secret_token"] != "token" {
+		t.Errorf("JSON params = %v", plain.json)
+	}
+	if multipart.fields["url"] != "https://example.com/path" || multipart.fields["secret_token"] != "token" {
+		t.Errorf("multipart fields = %v", multipart.fields)
+	}
+	if multipart.files["certificate"] != "cert.pem:certificate" {
+		t.Errorf("multipart files = %v", multipart.files)
+	}
+}
+
+func TestSendDocument(t *testing.T) {
+	document := filepath.Join(t.TempDir(), "backup.db")
+	if err := ioutil.WriteFile(document, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bot, requests := fakeAPI(t, map[string]string{
+		"sendDocument": `{"ok":true,"result":{"message_id":6,"chat":{"id":-100,"type":"supergroup"}}}`,
+	})
+	message, err := bot.SendDocument(-100, document, "caption")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.MessageID != 6 {
+		t.Errorf("message = %+v", message)
+	}
+	got := (*requests)[0]
+	if got.method != "sendDocument" || got.fields["chat_id"] != "-100" || got.fields["caption"] != "caption" {
+		t.Errorf("request = %+v", got)
+	}
+	if got.files["document"] != "backup.db:data" {
+		t.Errorf("files = %v", got.files)
+	}
+	if _, err := bot.SendDocument(1, filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Error("missing file is sent")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	command := func(text string, length int) *Message {
+		return &Message{Text: text, Entities: []MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}}
+	}
+	tests := []struct {
+		name      string
+		message   *Message
+		command   string
+		arguments string
+	}{
+		{"command", command("/start key", 6), "start", "key"},
+		{"bot name", command("/limit@smsq_bot 1 2", 15), "limit", "1 2"},
+		{"no arguments", command("/stop", 5), "stop", ""},
+		{"empty entity", command("/stop", 0), "", ""},
+		{"entity beyond the text", command("/a", 10), "a", ""},
+		{"empty text", command("", 5), "", ""},
+		{"negative length", command("/stop", -1), "", ""},
+		{"not a command", &Message{Text: "/stop"}, "", ""},
+		{"mention", &Message{Text: "@bot /stop", Entities: []MessageEntity{{Type: "mention", Length: 4}}}, "", ""},
+	}
+	for _, tt := range tests {
+		if got := tt.message.Command(); got != tt.command {
+			t.Errorf("%s: Command = %q, want %q", tt.name, got, tt.command)
+		}
+		if got := tt.message.CommandArguments(); got != tt.arguments {
+			t.Errorf("%s: CommandArguments = %q, want %q", tt.name, got, tt.arguments)
+		}
+	}
+}
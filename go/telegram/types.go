@@ -0,0 +1,124 @@
+package telegram
+
+import "strings"
+
+// Update is an incoming update
+type Update struct {
+	UpdateID    int      `json:"update_id"`
+	Message     *Message `json:"message,omitempty"`
+	ChannelPost *Message `json:"channel_post,omitempty"`
+}
+
+// User is a Telegram user or bot
+type User struct {
+	ID        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	Username  string `json:"username,omitempty"`
+}
+
+// Chat is a private chat, a group, a supergroup or a channel
+type Chat struct {
+	ID       int64  `json:"id"`
+	Type     string `json:"type"`
+	Title    string `json:"title,omitempty"`
+	Username string `json:"username,omitempty"`
+	IsForum  bool   `json:"is_forum,omitempty"`
+}
+
+// MessageEntity is a special entity in a text message, offsets are in UTF-16 code units
+type MessageEntity struct {
+	Type   string `json:"type"`
+	Offset int    `json:"offset"`
+	Length int    `json:"length"`
+}
+
+// Message is a message
+type Message struct {
+	MessageID       int             `json:"message_id"`
+	MessageThreadID int             `json:"message_thread_id,omitempty"`
+	From            *User           `json:"from,omitempty"`
+	Chat            *Chat           `json:"chat"`
+	Date            int64           `json:"date"`
+	Text            string          `json:"text,omitempty"`
+	Entities        []MessageEntity `json:"entities,omitempty"`
+	NewChatMembers  []User          `json:"new_chat_members,omitempty"`
+}
+
+// IsCommand checks if the message starts with a bot command
+func (m *Message) IsCommand() bool {
+	return len(m.Entities) != 0 && m.Entities[0].Offset == 0 && m.Entities[0].Length > 0 && m.Entities[0].Type == "bot_command"
+}
+
+// Command returns the command without the leading slash and the bot name
+func (m *Message) Command() string {
+	if !m.IsCommand() {
+		return ""
+	}
+	// the entity may be longer than the text
+	command := strings.TrimPrefix(m.commandWithAt(), "/")
+	if i := strings.Index(command, "@"); i != -1 {
+		command = command[:i]
+	}
+	return command
+}
+
+// CommandArguments returns the text after the command
+func (m *Message) CommandArguments() string {
+	if !m.IsCommand() {
+		return ""
+	}
+	return strings.TrimSpace(m.Text[len(m.commandWithAt()):])
+}
+
+// commandWithAt returns the command entity text, commands are ASCII so UTF-16 offsets are byte offsets
+func (m *Message) commandWithAt() string {
+	length := m.Entities[0].Length
+	if length > len(m.Text) {
+		length = len(m.Text)
+	}
+	return m.Text[:length]
+}
+
+// WebhookInfo is the current webhook status
+type WebhookInfo struct {
+	URL                  string `json:"url"`
+	HasCustomCertificate bool   `json:"has_custom_certificate"`
+	PendingUpdateCount   int    `json:"pending_update_count"`
+	LastErrorDate        int64  `json:"last_error_date,omitempty"`
+	LastErrorMessage     string `json:"last_error_message,omitempty"`
+}
+
+// LinkPreviewOptions describes link preview generation
+type LinkPreviewOptions struct {
+	IsDisabled bool `json:"is_disabled,omitempty"`
+}
+
+// SendMessageParams are sendMessage parameters
+type SendMessageParams struct {
+	ChatID              int64               `json:"chat_id"`
+	MessageThreadID     int                 `json:"message_thread_id,omitempty"`
+	Text                string              `json:"text"`
+	ParseMode           string              `json:"parse_mode,omitempty"`
+	DisableNotification bool                `json:"disable_notification,omitempty"`
+	LinkPreviewOptions  *LinkPreviewOptions `json:"link_preview_options,omitempty"`
+}
+
+// WebhookParams are setWebhook parameters
+type WebhookParams struct {
+	URL         string `json:"url"`
+	SecretToken string `json:"secret_token,omitempty"`
+	Certificate string `json:"-"` // a self-signed certificate file to upload
+}
+
+// ChatMember is a chat member status
+type ChatMember struct {
+	Status string `json:"status"` // creator, administrator, member, restricted, left or kicked
+	User   *User  `json:"user"`
+}
+
+// ForumTopic is a forum topic
+type ForumTopic struct {
+	MessageThreadID int    `json:"message_thread_id"`
+	Name            string `json:"name"`
+}